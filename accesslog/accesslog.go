@@ -0,0 +1,230 @@
+// Package accesslog writes structured (log/slog) access logs for apiproxy's
+// reverse proxy, including each request's cache outcome, upstream status and
+// latency, and the Validator rule that was applied to it.
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/sourcegraph/apiproxy"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader is the header that carries request IDs. Handler uses the
+// request's ID if it has one and generates one otherwise, and sets it on the
+// request (so that it is sent upstream) and the response.
+const RequestIDHeader = "X-Request-Id"
+
+// redacted replaces the values of redacted headers and query parameters.
+const redacted = "REDACTED"
+
+// DefaultRedactHeaders are the headers whose values are redacted by default.
+var DefaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+// DefaultRedactParams are the query parameters whose values are redacted by
+// default.
+var DefaultRedactParams = []string{"access_token", "client_secret", "private_token", "token"}
+
+// Logger logs a record for each request served by a handler wrapped with
+// Handler. Use InstrumentCacheStats to add the cache outcome to the records of
+// requests served through a caching transport.
+type Logger struct {
+	// SampleRate is the fraction of requests that are logged, between 0 and
+	// 1. Requests that fail with a 5xx status are always logged.
+	SampleRate float64
+
+	// RedactHeaders are the (case-insensitive) names of headers whose values
+	// are replaced with "REDACTED".
+	RedactHeaders []string
+
+	// RedactParams are the (case-insensitive) names of URL query parameters
+	// whose values are replaced with "REDACTED".
+	RedactParams []string
+
+	// Headers is whether to log request headers (with RedactHeaders
+	// redacted).
+	Headers bool
+
+	logger *slog.Logger
+}
+
+// New returns a Logger that writes to logger, logging every request and
+// redacting DefaultRedactHeaders and DefaultRedactParams.
+func New(logger *slog.Logger) *Logger {
+	return &Logger{
+		SampleRate:    1,
+		RedactHeaders: DefaultRedactHeaders,
+		RedactParams:  DefaultRedactParams,
+		logger:        logger,
+	}
+}
+
+// entryKey is the request context key for an *entry.
+type entryKey struct{}
+
+// entry holds the cache event for a request, if any.
+type entry struct {
+	event *apiproxy.CacheEvent
+}
+
+// InstrumentCacheStats sets s.OnRequest (calling any existing hook as well) to
+// add the route pattern, cache outcome, Validator rule, and upstream status
+// and latency to each request's record.
+func (l *Logger) InstrumentCacheStats(s *apiproxy.CacheStats) {
+	prev := s.OnRequest
+	s.OnRequest = func(e apiproxy.CacheEvent) {
+		if prev != nil {
+			prev(e)
+		}
+		if ent, ok := e.Request.Context().Value(entryKey{}).(*entry); ok {
+			ent.event = &e
+		}
+	}
+}
+
+// Handler returns a handler that serves requests with h and logs them.
+func (l *Logger) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ent := new(entry)
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), entryKey{}, ent)))
+
+		if rw.status < 500 && mathrand.Float64() >= l.SampleRate {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("url", l.redactURL(r.URL)),
+			slog.String("proto", r.Proto),
+			slog.String("remote_addr", remoteHost(r.RemoteAddr)),
+			slog.String("user_agent", r.UserAgent()),
+			slog.Int("status", rw.status),
+			slog.Int64("bytes", rw.bytes),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if e := ent.event; e != nil {
+			cache := []any{
+				slog.String("outcome", string(e.Outcome)),
+				slog.String("route", e.Pattern),
+			}
+			if e.Rule != "" {
+				cache = append(cache, slog.String("rule", e.Rule))
+			}
+			attrs = append(attrs, slog.Group("cache", cache...))
+			if e.UpstreamStatusCode != 0 {
+				attrs = append(attrs, slog.Group("upstream",
+					slog.Int("status", e.UpstreamStatusCode),
+					slog.Duration("duration", e.UpstreamDuration),
+				))
+			}
+		}
+		if l.Headers {
+			attrs = append(attrs, slog.Any("headers", l.redactHeader(r.Header)))
+		}
+		l.logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// redactURL returns the string form of u with the values of l.RedactParams
+// replaced, matching parameter names case-insensitively.
+func (l *Logger) redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	q := u.Query()
+	for param, vs := range q {
+		for _, name := range l.RedactParams {
+			if strings.EqualFold(param, name) {
+				for i := range vs {
+					vs[i] = redacted
+				}
+				break
+			}
+		}
+	}
+	u2 := *u
+	u2.RawQuery = q.Encode()
+	return u2.RequestURI()
+}
+
+// redactHeader returns a copy of h with the values of l.RedactHeaders replaced.
+func (l *Logger) redactHeader(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, vs := range h {
+		m[k] = strings.Join(vs, ", ")
+	}
+	for _, name := range l.RedactHeaders {
+		if _, present := h[http.CanonicalHeaderKey(name)]; present {
+			m[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	return m
+}
+
+// newRequestID returns a random 16-byte hex request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// remoteHost returns the host part of addr.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// responseWriter records the status code and number of bytes written.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements net/http.Flusher (used by the reverse proxy to stream
+// responses).
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for net/http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/sourcegraph/apiproxy"
+	"github.com/sourcegraph/httpcache"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var upstreamRequestIDs []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestIDs = append(upstreamRequestIDs, r.Header.Get(RequestIDHeader))
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"foo"`)
+		w.Write([]byte("foo"))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	stats := &apiproxy.CacheStats{}
+	proxy := apiproxy.NewCachingSingleHostReverseProxy(targetURL, nil)
+	cachingTransport := proxy.Transport.(*httpcache.Transport)
+	cachingTransport.Transport = &apiproxy.RevalidationTransport{
+		Check:     apiproxy.PathMatchValidator{regexp.MustCompile(`^/repos/`): time.Hour},
+		Transport: stats.UpstreamTransport(nil),
+	}
+	proxy.Transport = stats.Transport(cachingTransport)
+
+	var buf bytes.Buffer
+	logger := New(slog.New(slog.NewJSONHandler(&buf, nil)))
+	logger.Headers = true
+	logger.InstrumentCacheStats(stats)
+	server := httptest.NewServer(logger.Handler(proxy))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/repos/a/b?access_token=secret&page=2", nil)
+		req.Header.Set("Authorization", "token secret")
+		if i == 1 {
+			req.Header.Set(RequestIDHeader, "my-id")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Do", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get(RequestIDHeader) == "" {
+			t.Errorf("request %d: want %s response header", i, RequestIDHeader)
+		}
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Errorf("want secrets redacted, got log:\n%s", buf.Bytes())
+	}
+
+	type record struct {
+		RequestID string `json:"request_id"`
+		URL       string `json:"url"`
+		Status    int
+		Cache     struct {
+			Outcome string
+			Rule    string
+		}
+		Upstream struct {
+			Status int
+		}
+		Headers map[string]string
+	}
+	var records []record
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var r record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("want 2 records, got %d", len(records))
+	}
+
+	if want, got := "/repos/a/b?access_token=REDACTED&page=2", records[0].URL; want != got {
+		t.Errorf("want url %q, got %q", want, got)
+	}
+	if want, got := "REDACTED", records[0].Headers["Authorization"]; want != got {
+		t.Errorf("want Authorization header %q, got %q", want, got)
+	}
+	if records[0].RequestID == "" || records[0].RequestID != upstreamRequestIDs[0] {
+		t.Errorf("want generated request ID sent upstream, got %q (upstream %q)", records[0].RequestID, upstreamRequestIDs[0])
+	}
+	if want, got := "my-id", records[1].RequestID; want != got {
+		t.Errorf("want request ID %q, got %q", want, got)
+	}
+	if want, got := string(apiproxy.CacheMiss), records[0].Cache.Outcome; want != got {
+		t.Errorf("want first outcome %q, got %q", want, got)
+	}
+	if want, got := http.StatusOK, records[0].Upstream.Status; want != got {
+		t.Errorf("want first upstream status %d, got %d", want, got)
+	}
+	if want, got := string(apiproxy.CacheSynthesized), records[1].Cache.Outcome; want != got {
+		t.Errorf("want second outcome %q, got %q", want, got)
+	}
+	if want, got := "^/repos/", records[1].Cache.Rule; want != got {
+		t.Errorf("want second rule %q, got %q", want, got)
+	}
+	if want, got := 0, records[1].Upstream.Status; want != got {
+		t.Errorf("want no upstream status for second request, got %d", got)
+	}
+}
+
+func TestLogger_SampleRate(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	var buf bytes.Buffer
+	logger := New(slog.New(slog.NewJSONHandler(&buf, nil)))
+	logger.SampleRate = 0
+	server := httptest.NewServer(logger.Handler(h))
+	defer server.Close()
+
+	for _, path := range []string{"/ok", "/error"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		resp.Body.Close()
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 1 {
+		t.Fatalf("want 1 record (for the error), got %d:\n%s", n, buf.Bytes())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"url":"/error"`)) {
+		t.Errorf("want error logged, got %s", buf.Bytes())
+	}
+}
+
+func TestLogger_redactURL(t *testing.T) {
+	l := &Logger{RedactParams: DefaultRedactParams}
+	tests := map[string]string{
+		"/a":                           "/a",
+		"/a?page=2":                    "/a?page=2",
+		"/a?access_token=x&page=2":     "/a?access_token=REDACTED&page=2",
+		"/a?Access_Token=x&page=2":     "/a?Access_Token=REDACTED&page=2",
+		"/a?TOKEN=x&token=y&PAGE=2":    "/a?PAGE=2&TOKEN=REDACTED&token=REDACTED",
+		"/a?Private_Token=x&Private=y": "/a?Private=y&Private_Token=REDACTED",
+	}
+	for uri, want := range tests {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.redactURL(u); got != want {
+			t.Errorf("%s: want %q, got %q", uri, want, got)
+		}
+	}
+}
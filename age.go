@@ -0,0 +1,77 @@
+package apiproxy
+
+import (
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestTimeHeader and responseTimeHeader are set by RevalidationTransport on
+// responses from the upstream server to the times the request was sent and
+// the response was received, so that the ages of cached responses can be
+// computed.
+const (
+	requestTimeHeader  = "X-Apiproxy-Request-Time"
+	responseTimeHeader = "X-Apiproxy-Response-Time"
+)
+
+// setResponseTimes sets the request and response time headers.
+func setResponseTimes(h http.Header, requestTime, responseTime time.Time) {
+	h.Set(requestTimeHeader, requestTime.UTC().Format(http.TimeFormat))
+	h.Set(responseTimeHeader, responseTime.UTC().Format(http.TimeFormat))
+}
+
+// cacheEntryAge returns the age of the cache entry that req revalidates. If
+// cached (the cached response's headers) is non-nil, the age is computed from
+// it; otherwise, it is taken from req's X-Cache-Age header. If the age is
+// unknown, ok is false.
+func cacheEntryAge(req *http.Request, cached http.Header) (age time.Duration, ok bool) {
+	if cached != nil {
+		return currentAge(cached, time.Now())
+	}
+	s, err := strconv.ParseInt(req.Header.Get(httpcache.XCacheAge), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// currentAge returns the age at now of a response with the given headers, as
+// described in RFC 9111 section 4.2.3. The times at which the request was sent
+// and the response was received are taken from the response time headers; if
+// they are absent, the response is assumed to have been received at its Date
+// without delay. If the response has neither, ok is false.
+func currentAge(h http.Header, now time.Time) (age time.Duration, ok bool) {
+	date, dateErr := http.ParseTime(h.Get("Date"))
+	responseTime, err := http.ParseTime(h.Get(responseTimeHeader))
+	if err != nil {
+		if dateErr != nil {
+			return 0, false
+		}
+		responseTime = date
+	}
+	requestTime, err := http.ParseTime(h.Get(requestTimeHeader))
+	if err != nil || requestTime.After(responseTime) {
+		requestTime = responseTime
+	}
+
+	var apparentAge time.Duration
+	if dateErr == nil && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	var ageValue time.Duration
+	if s, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && s > 0 {
+		ageValue = time.Duration(s) * time.Second
+	}
+	correctedAgeValue := ageValue + responseTime.Sub(requestTime)
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	residentTime := now.Sub(responseTime)
+	if residentTime < 0 {
+		residentTime = 0
+	}
+	return correctedInitialAge + residentTime, true
+}
@@ -0,0 +1,55 @@
+package apiproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCurrentAge(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+	tests := []struct {
+		header  http.Header
+		want    time.Duration
+		wantOK  bool
+		comment string
+	}{
+		{header: http.Header{}, comment: "no Date"},
+		{header: http.Header{"Date": {at(-time.Minute)}}, want: time.Minute, wantOK: true},
+		{header: http.Header{"Date": {at(-time.Minute)}, "Age": {"30"}}, want: 90 * time.Second, wantOK: true},
+		{
+			header: http.Header{
+				"Date":             {at(-2 * time.Minute)},
+				requestTimeHeader:  {at(-time.Minute - 5*time.Second)},
+				responseTimeHeader: {at(-time.Minute)},
+			},
+			want:    2 * time.Minute,
+			wantOK:  true,
+			comment: "apparent age from a lagging Date",
+		},
+		{
+			header: http.Header{
+				"Date":             {at(-time.Minute)},
+				"Age":              {"10"},
+				requestTimeHeader:  {at(-time.Minute - 5*time.Second)},
+				responseTimeHeader: {at(-time.Minute)},
+			},
+			want:    75 * time.Second,
+			wantOK:  true,
+			comment: "Age corrected for response delay",
+		},
+		{
+			header:  http.Header{responseTimeHeader: {at(-time.Minute)}},
+			want:    time.Minute,
+			wantOK:  true,
+			comment: "response time without Date",
+		},
+	}
+	for _, test := range tests {
+		age, ok := currentAge(test.header, now)
+		if age != test.want || ok != test.wantOK {
+			t.Errorf("%v (%s): want age %s (ok %v), got %s (ok %v)", test.header, test.comment, test.want, test.wantOK, age, ok)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sourcegraph/httpcache"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by CircuitBreakerTransport for requests that are
+// short-circuited by an open circuit (unless OpenStatusCode is set).
+var ErrCircuitOpen = errors.New("apiproxy: circuit open")
+
+// CircuitState is the state of a circuit in a CircuitBreakerTransport.
+type CircuitState int
+
+const (
+	// CircuitClosed means requests are sent upstream.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means requests are short-circuited without being sent
+	// upstream.
+	CircuitOpen
+
+	// CircuitHalfOpen means a single probe request is sent upstream to
+	// determine whether to close the circuit; other requests are
+	// short-circuited.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "CircuitState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreakerTransport is an implementation of net/http.RoundTripper that
+// stops sending requests to an upstream server that is failing, so that they
+// fail fast instead of waiting for a timeout.
+//
+// Requests are grouped into circuits by host and path pattern. A circuit opens
+// after FailureThreshold consecutive requests fail (with an error or a 5xx
+// response). While it is open, requests with cache validators (i.e., those
+// made by a caching transport to revalidate a stale cache entry) get a
+// synthesized 304 Not Modified response, so that the stale entry is used; other
+// requests fail with ErrCircuitOpen (or a response with OpenStatusCode). After
+// OpenTimeout, the circuit half-opens and lets a probe request through, which
+// closes the circuit if it succeeds and reopens it otherwise.
+//
+// Like RevalidationTransport, it should be the underlying transport of a
+// caching transport. CircuitBreakerTransport is an http.Handler that serves the
+// status of its circuits as JSON.
+type CircuitBreakerTransport struct {
+	// Patterns are the path regexps that requests are grouped by. A request's
+	// circuit is for its host and the first pattern that matches its escaped
+	// path (or just its host if none match).
+	Patterns []*regexp.Regexp
+
+	// FailureThreshold is the number of consecutive failures that open a
+	// circuit. If zero, DefaultFailureThreshold is used.
+	FailureThreshold int
+
+	// OpenTimeout is how long a circuit stays open before half-opening. If
+	// zero, DefaultOpenTimeout is used.
+	OpenTimeout time.Duration
+
+	// OpenStatusCode, if nonzero, is the status code of the response to
+	// short-circuited requests that can't be served from the cache (with a
+	// Retry-After header giving the time until the circuit half-opens).
+	// Otherwise, RoundTrip returns ErrCircuitOpen for such requests.
+	OpenStatusCode int
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	// Cache, if non-nil, is the cache of the caching transport that uses this
+	// transport. As with RevalidationTransport's Cache, synthesized 304 Not
+	// Modified responses then carry the cached entry's Date, ETag,
+	// Last-Modified, Cache-Control, Expires and Vary headers, and requests for
+	// a different variant of the cached entry (by its Vary header) are
+	// short-circuited like requests without cache validators. If nil, 304
+	// responses only carry the validators from the request.
+	Cache httpcache.Cache
+
+	// OnStateChange, if non-nil, is called when a circuit changes state. It
+	// is called with the transport's lock held, so it must not call the
+	// transport's methods.
+	OnStateChange func(circuit string, state CircuitState)
+
+	circuits map[string]*circuit
+	mu       sync.Mutex
+}
+
+// Defaults for CircuitBreakerTransport's fields.
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+)
+
+// CircuitStatus describes the status of a circuit.
+type CircuitStatus struct {
+	State CircuitState
+
+	// Failures is the number of consecutive failures.
+	Failures int
+
+	// OpenedAt is when the circuit last opened.
+	OpenedAt time.Time
+}
+
+type circuit struct {
+	CircuitStatus
+	probing bool
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *CircuitBreakerTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	key := t.circuitKey(req)
+	allowed, retryAfter := t.allow(key)
+	if !allowed {
+		return t.shortCircuit(req, retryAfter)
+	}
+
+	resp, err = transport.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// The request was canceled, which says nothing about the upstream
+		// server's health.
+		t.release(key)
+	case err != nil || resp.StatusCode >= 500:
+		t.record(key, true)
+	default:
+		t.record(key, false)
+	}
+	return
+}
+
+// circuitKey returns the key of req's circuit.
+func (t *CircuitBreakerTransport) circuitKey(req *http.Request) string {
+	for _, re := range t.Patterns {
+		if re.MatchString(req.URL.EscapedPath()) {
+			return req.URL.Host + " " + re.String()
+		}
+	}
+	return req.URL.Host
+}
+
+// allow returns true if a request in the circuit key may be sent upstream.
+// Otherwise, it returns the time until the circuit half-opens.
+func (t *CircuitBreakerTransport) allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.circuit(key)
+	switch c.State {
+	case CircuitOpen:
+		if wait := c.OpenedAt.Add(t.openTimeout()).Sub(time.Now()); wait > 0 {
+			return false, wait
+		}
+		t.setState(key, c, CircuitHalfOpen)
+		c.probing = true
+		return true, 0
+	case CircuitHalfOpen:
+		if c.probing {
+			return false, 0
+		}
+		c.probing = true
+	}
+	return true, 0
+}
+
+// record records the result of a request in the circuit key.
+func (t *CircuitBreakerTransport) record(key string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.circuit(key)
+	switch c.State {
+	case CircuitClosed:
+		if !failed {
+			c.Failures = 0
+			return
+		}
+		c.Failures++
+		threshold := t.FailureThreshold
+		if threshold == 0 {
+			threshold = DefaultFailureThreshold
+		}
+		if c.Failures >= threshold {
+			c.OpenedAt = time.Now()
+			t.setState(key, c, CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		c.probing = false
+		if failed {
+			c.Failures++
+			c.OpenedAt = time.Now()
+			t.setState(key, c, CircuitOpen)
+		} else {
+			c.Failures = 0
+			t.setState(key, c, CircuitClosed)
+		}
+	}
+}
+
+// release ends a request in the circuit key without recording its result.
+func (t *CircuitBreakerTransport) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.circuit(key).probing = false
+}
+
+// circuit returns the circuit for key, creating it if necessary. The caller
+// must hold t.mu.
+func (t *CircuitBreakerTransport) circuit(key string) *circuit {
+	if t.circuits == nil {
+		t.circuits = make(map[string]*circuit)
+	}
+	c := t.circuits[key]
+	if c == nil {
+		c = new(circuit)
+		t.circuits[key] = c
+	}
+	return c
+}
+
+// setState sets the state of c (the circuit for key) and calls
+// t.OnStateChange. The caller must hold t.mu.
+func (t *CircuitBreakerTransport) setState(key string, c *circuit, state CircuitState) {
+	c.State = state
+	if t.OnStateChange != nil {
+		t.OnStateChange(key, state)
+	}
+}
+
+func (t *CircuitBreakerTransport) openTimeout() time.Duration {
+	if t.OpenTimeout == 0 {
+		return DefaultOpenTimeout
+	}
+	return t.OpenTimeout
+}
+
+// shortCircuit returns the response to req when its circuit is open.
+func (t *CircuitBreakerTransport) shortCircuit(req *http.Request, retryAfter time.Duration) (*http.Response, error) {
+	if hasCacheValidator(req.Header) {
+		var cached http.Header
+		matches := true
+		if t.Cache != nil {
+			if cachedResp := cachedResponse(t.Cache, req); cachedResp != nil {
+				cached = cachedResp.Header
+				matches = varyMatches(cached, req)
+			}
+		}
+		if matches {
+			if result := requestUpstreamResult(req); result != nil {
+				result.synthesized = true
+			}
+			return notModified(req, cached), nil
+		}
+	}
+	if t.OpenStatusCode == 0 {
+		return nil, ErrCircuitOpen
+	}
+	body := fmt.Sprintf("%s: %s\n", ErrCircuitOpen, req.URL.Host)
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.OpenStatusCode, http.StatusText(t.OpenStatusCode)),
+		StatusCode:    t.OpenStatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(body)),
+		Request:       localRequest(req),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+	return resp, nil
+}
+
+// Circuits returns a snapshot of the status of each circuit.
+func (t *CircuitBreakerTransport) Circuits() map[string]CircuitStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	circuits := make(map[string]CircuitStatus, len(t.circuits))
+	for key, c := range t.circuits {
+		circuits[key] = c.CircuitStatus
+	}
+	return circuits
+}
+
+// ServeHTTP implements net/http.Handler by writing the status of each circuit
+// as JSON.
+func (t *CircuitBreakerTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.MarshalIndent(t.Circuits(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,146 @@
+package apiproxy
+
+import (
+	"errors"
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	upstreamDown := true
+	requestCount := 0
+	var states []CircuitState
+	transport := &CircuitBreakerTransport{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Hour,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requestCount++
+			if upstreamDown {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+		OnStateChange: func(circuit string, state CircuitState) {
+			if want := "example.com"; circuit != want {
+				t.Errorf("want circuit %q, got %q", want, circuit)
+			}
+			states = append(states, state)
+		},
+	}
+
+	// The circuit opens after 2 failures.
+	for i := 0; i < 2; i++ {
+		if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo")); err == nil {
+			t.Fatal("want error while upstream is down")
+		}
+	}
+	if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo")); err != ErrCircuitOpen {
+		t.Errorf("want ErrCircuitOpen, got %v", err)
+	}
+	if want := 2; requestCount != want {
+		t.Errorf("want %d upstream requests, got %d", want, requestCount)
+	}
+
+	// Revalidation requests get a synthesized 304 while the circuit is open.
+	req := newHTTPGETRequest(t, "http://example.com/foo")
+	req.Header.Set("If-None-Match", `"foo"`)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if want := http.StatusNotModified; resp.StatusCode != want {
+		t.Errorf("want status code %d, got %d", want, resp.StatusCode)
+	}
+
+	// Short-circuited requests can get an error response instead.
+	transport.OpenStatusCode = http.StatusServiceUnavailable
+	resp, err = transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo"))
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if want := http.StatusServiceUnavailable; resp.StatusCode != want {
+		t.Errorf("want status code %d, got %d", want, resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("want Retry-After header")
+	}
+
+	// After OpenTimeout, a successful probe closes the circuit.
+	transport.OpenTimeout = time.Nanosecond
+	upstreamDown = false
+	resp, err = transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo"))
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if want := http.StatusOK; resp.StatusCode != want {
+		t.Errorf("want status code %d, got %d", want, resp.StatusCode)
+	}
+	if want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}; !reflect.DeepEqual(want, states) {
+		t.Errorf("want states %v, got %v", want, states)
+	}
+	if want, got := (CircuitStatus{State: CircuitClosed}), transport.Circuits()["example.com"]; want.State != got.State || want.Failures != got.Failures {
+		t.Errorf("want circuit status %+v, got %+v", want, got)
+	}
+}
+
+func TestCircuitBreakerTransport_halfOpenFailure(t *testing.T) {
+	transport := &CircuitBreakerTransport{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Nanosecond,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo"))
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		resp.Body.Close()
+	}
+	if want, got := CircuitOpen, transport.Circuits()["example.com"].State; want != got {
+		t.Errorf("want state %s after failed probe, got %s", want, got)
+	}
+}
+
+func TestCircuitBreakerTransport_cache(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	date := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	cache.Set("http://example.com/foo", []byte("HTTP/1.1 200 OK\r\nDate: "+date+"\r\nEtag: \"foo\"\r\nCache-Control: max-age=60\r\nVary: Accept\r\nX-Varied-Accept: application/json\r\nContent-Length: 0\r\n\r\n"))
+
+	transport := &CircuitBreakerTransport{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Hour,
+		Cache:            cache,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}),
+	}
+	transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo"))
+
+	// The synthesized 304 carries the cached entry's headers.
+	req := newHTTPGETRequest(t, "http://example.com/foo")
+	req.Header.Set("If-None-Match", `"foo"`)
+	req.Header.Set("Accept", "application/json")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if want := http.StatusNotModified; resp.StatusCode != want {
+		t.Errorf("want status code %d, got %d", want, resp.StatusCode)
+	}
+	for name, want := range map[string]string{"Date": date, "Cache-Control": "max-age=60", "Vary": "Accept", "Etag": `"foo"`} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("want %s header %q, got %q", name, want, got)
+		}
+	}
+
+	// Requests for a different variant are short-circuited.
+	req.Header.Set("Accept", "text/html")
+	if _, err := transport.RoundTrip(req); err != ErrCircuitOpen {
+		t.Errorf("want ErrCircuitOpen for a different variant, got %v", err)
+	}
+}
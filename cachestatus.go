@@ -0,0 +1,119 @@
+package apiproxy
+
+import (
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatusName is the cache name used in the Cache-Status response headers
+// added by NewCachingSingleHostReverseProxy.
+const CacheStatusName = "apiproxy"
+
+// setCacheStatus appends an entry to resp's Cache-Status header (see RFC 9211)
+// describing how it was served, and sets its Age header if it was served from
+// the cache. It also removes the response time headers set by
+// RevalidationTransport and the X-Varied-* headers set by httpcache.
+func setCacheStatus(resp *http.Response) {
+	var result upstreamResult
+	if resp.Request != nil {
+		if r := requestUpstreamResult(resp.Request); r != nil {
+			result = *r
+		}
+	}
+	fromCache := resp.Header.Get(httpcache.XFromCache) != ""
+
+	var age time.Duration
+	if fromCache {
+		age, _ = currentAge(resp.Header, time.Now())
+		resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+
+	status := CacheStatusName
+	switch {
+	case result.synthesized || (fromCache && !result.contacted):
+		status += "; hit"
+		if lifetime, ok := freshnessLifetime(resp.Header); ok {
+			status += "; ttl=" + strconv.FormatInt(int64((lifetime-age)/time.Second), 10)
+		}
+	case fromCache:
+		status += "; fwd=stale; fwd-status=" + strconv.Itoa(result.statusCode)
+	default:
+		fwd := "miss"
+		if req := resp.Request; req != nil {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				fwd = "method"
+			} else if hasDirective(req.Header.Get("Cache-Control"), "no-cache") || req.Header.Get("Pragma") == "no-cache" {
+				fwd = "request"
+			}
+		}
+		status += "; fwd=" + fwd + "; fwd-status=" + strconv.Itoa(resp.StatusCode)
+	}
+	if result.rule != "" {
+		status += `; detail="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(result.rule) + `"`
+	}
+
+	// Keep Cache-Status entries from upstream caches, but not our own (which
+	// may have been stored along with cached responses).
+	var statuses []string
+	for _, s := range resp.Header["Cache-Status"] {
+		if s != CacheStatusName && !strings.HasPrefix(s, CacheStatusName+";") {
+			statuses = append(statuses, s)
+		}
+	}
+	resp.Header["Cache-Status"] = append(statuses, status)
+	resp.Header.Del(requestTimeHeader)
+	resp.Header.Del(responseTimeHeader)
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "X-Varied-") {
+			delete(resp.Header, name)
+		}
+	}
+}
+
+// freshnessLifetime returns the freshness lifetime of a response with the given
+// headers, from its s-maxage or max-age directive or its Expires header. If
+// none are present, ok is false.
+func freshnessLifetime(h http.Header) (lifetime time.Duration, ok bool) {
+	cc := h.Get("Cache-Control")
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, present := directiveValue(cc, name); present {
+			if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Duration(s) * time.Second, true
+			}
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			return 0, true
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// hasDirective reports whether the Cache-Control header value cc contains the
+// directive name.
+func hasDirective(cc, name string) bool {
+	_, present := directiveValue(cc, name)
+	return present
+}
+
+// directiveValue returns the value of the directive name in the Cache-Control
+// header value cc.
+func directiveValue(cc, name string) (value string, present bool) {
+	for _, part := range strings.Split(cc, ",") {
+		part = strings.TrimSpace(part)
+		k, v := part, ""
+		if eq := strings.Index(part, "="); eq != -1 {
+			k, v = strings.TrimSpace(part[:eq]), strings.Trim(strings.TrimSpace(part[eq+1:]), `"`)
+		}
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -3,23 +3,31 @@ package apiproxy
 import (
 	"net/http"
 	"net/textproto"
+	"net/url"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // RequestModifyingTransport is an implementation of net/http.RoundTripper that
-// allows headers to be overwritten on requests matching certain predicates.
+// allows requests matching certain predicates to be modified (e.g., to
+// overwrite headers, edit the query, rewrite the path, or change the host).
 //
 // It gives more control over HTTP requests (e.g., caching) when using libraries
 // whose only HTTP configuration point is a http.Client or http.RoundTripper.
 type RequestModifyingTransport struct {
-	overrides   map[*regexp.Regexp]requestOverride
+	overrides   []*RequestOverride // in order of application
 	overridesMu sync.Mutex
 
 	// Transport is the underlying transport. If nil, net/http.DefaultTransport
 	// is used.
 	Transport http.RoundTripper
+
+	// OnOverride, if non-nil, is called with the request and the request URI
+	// regexp of each override or rule that is applied. It must not call the
+	// transport's methods (or Remove).
+	OnOverride func(req *http.Request, requestURI *regexp.Regexp)
 }
 
 // RoundTrip implements net/http.RoundTripper.
@@ -34,25 +42,175 @@ func (t *RequestModifyingTransport) RoundTrip(req *http.Request) (resp *http.Res
 	return transport.RoundTrip(req)
 }
 
-// requestOverride represents how a request should be modified by
-// RequestModifyingTransport.
-type requestOverride struct {
-	setHeaders  http.Header
-	runOnlyOnce bool
+// RequestRule describes how RequestModifyingTransport modifies requests that
+// match it.
+type RequestRule struct {
+	// Methods are the request methods that the rule applies to. If empty, it
+	// applies to GET and HEAD requests.
+	Methods []string
+
+	// Host, if non-nil, must match the request's host for the rule to apply.
+	Host *regexp.Regexp
+
+	// DeleteHeaders are the names of headers to delete.
+	DeleteHeaders []string
+
+	// SetHeaders are set on the request, overwriting existing headers of the
+	// same name.
+	SetHeaders http.Header
+
+	// AddHeaders are added to the request's headers, after any existing
+	// values.
+	AddHeaders http.Header
+
+	// DeleteQuery are the names of query parameters to delete.
+	DeleteQuery []string
+
+	// SetQuery are set on the request's query, overwriting existing
+	// parameters of the same name.
+	SetQuery url.Values
+
+	// RewritePath, if non-nil, is replaced by PathReplacement in the
+	// request's (escaped) path, as in regexp.Regexp.ReplaceAllString.
+	RewritePath     *regexp.Regexp
+	PathReplacement string
+
+	// SetHost, if set, is the host to send the request to.
+	SetHost string
+
+	// RunOnlyOnce causes the rule to be deleted after it is applied once.
+	RunOnlyOnce bool
+
+	// MaxUses, if nonzero, causes the rule to be deleted after it is applied
+	// this many times.
+	MaxUses int
+
+	// Expires, if nonzero, is when the rule is deleted.
+	Expires time.Time
+
+	// Priority determines the order in which rules are applied: rules with
+	// lower priorities are applied first, so that rules with higher
+	// priorities have the final say (e.g., over SetHeaders), and rules with
+	// the same priority are applied in the order they were added.
+	Priority int
+}
+
+// RequestOverride is a rule in a RequestModifyingTransport.
+type RequestOverride struct {
+	// RequestURI matches the request URIs that the rule applies to.
+	RequestURI *regexp.Regexp
+
+	Rule RequestRule
+
+	// Uses is the number of times the rule has been applied (it is ignored by
+	// Replace).
+	Uses int
+}
+
+// OverrideHandle refers to a rule added to a RequestModifyingTransport.
+type OverrideHandle struct {
+	t *RequestModifyingTransport
+	o *RequestOverride
+}
+
+// Remove deletes the rule from the transport. It returns false if the rule had
+// already been deleted (e.g., because it expired or was replaced).
+func (h *OverrideHandle) Remove() bool {
+	h.t.overridesMu.Lock()
+	defer h.t.overridesMu.Unlock()
+	return h.t.remove(h.o)
 }
 
 // Override instructs the transport to set the specified headers (overwriting
 // existing headers of the same name) on a GET or HEAD request whose request URI
 // matches the regexp. If runOnlyOnce is true, the override will be deleted
 // after execution (and won't affect any future requests); otherwise, it will
-// remain in effect for the lifetime of the transport.
-func (t *RequestModifyingTransport) Override(requestURI *regexp.Regexp, setHeaders http.Header, runOnlyOnce bool) {
+// remain in effect for the lifetime of the transport (or until removed with the
+// returned handle).
+func (t *RequestModifyingTransport) Override(requestURI *regexp.Regexp, setHeaders http.Header, runOnlyOnce bool) *OverrideHandle {
+	return t.AddRule(requestURI, RequestRule{SetHeaders: setHeaders, RunOnlyOnce: runOnlyOnce})
+}
+
+// AddRule instructs the transport to modify requests whose request URI matches
+// the regexp (and that match the rule's Methods and Host) as described by rule.
+// It replaces any existing rule or override for the same regexp.
+func (t *RequestModifyingTransport) AddRule(requestURI *regexp.Regexp, rule RequestRule) *OverrideHandle {
+	t.overridesMu.Lock()
+	defer t.overridesMu.Unlock()
+	for _, o := range t.overrides {
+		if o.RequestURI == requestURI {
+			t.remove(o)
+			break
+		}
+	}
+	return t.add(requestURI, rule)
+}
+
+// List returns a snapshot of the transport's unexpired rules, in the order in
+// which they are applied.
+func (t *RequestModifyingTransport) List() []RequestOverride {
 	t.overridesMu.Lock()
 	defer t.overridesMu.Unlock()
-	if t.overrides == nil {
-		t.overrides = make(map[*regexp.Regexp]requestOverride)
+	t.removeExpired(time.Now())
+	overrides := make([]RequestOverride, len(t.overrides))
+	for i, o := range t.overrides {
+		overrides[i] = *o
+	}
+	return overrides
+}
+
+// Replace atomically replaces all of the transport's rules with overrides, and
+// returns handles for the new rules.
+func (t *RequestModifyingTransport) Replace(overrides []RequestOverride) []*OverrideHandle {
+	t.overridesMu.Lock()
+	defer t.overridesMu.Unlock()
+	t.overrides = nil
+	handles := make([]*OverrideHandle, len(overrides))
+	for i, o := range overrides {
+		handles[i] = t.add(o.RequestURI, o.Rule)
+	}
+	return handles
+}
+
+// add inserts a rule after existing rules with the same or lower priority.
+// The caller must hold t.overridesMu.
+func (t *RequestModifyingTransport) add(requestURI *regexp.Regexp, rule RequestRule) *OverrideHandle {
+	o := &RequestOverride{RequestURI: requestURI, Rule: rule}
+	i := len(t.overrides)
+	for i > 0 && t.overrides[i-1].Rule.Priority > rule.Priority {
+		i--
+	}
+	t.overrides = append(t.overrides, nil)
+	copy(t.overrides[i+1:], t.overrides[i:])
+	t.overrides[i] = o
+	return &OverrideHandle{t, o}
+}
+
+// remove deletes o, returning false if it isn't present. The caller must hold
+// t.overridesMu.
+func (t *RequestModifyingTransport) remove(o *RequestOverride) bool {
+	for i, o2 := range t.overrides {
+		if o2 == o {
+			t.overrides = append(t.overrides[:i], t.overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// removeExpired deletes the rules that expired before now. The caller must
+// hold t.overridesMu.
+func (t *RequestModifyingTransport) removeExpired(now time.Time) {
+	overrides := t.overrides[:0]
+	for _, o := range t.overrides {
+		if o.Rule.Expires.IsZero() || now.Before(o.Rule.Expires) {
+			overrides = append(overrides, o)
+		}
 	}
-	t.overrides[requestURI] = requestOverride{setHeaders, runOnlyOnce}
+	for i := len(overrides); i < len(t.overrides); i++ {
+		t.overrides[i] = nil
+	}
+	t.overrides = overrides
 }
 
 var NoCache = http.Header{"Cache-Control": []string{"no-cache"}}
@@ -60,34 +218,94 @@ var NoCache = http.Header{"Cache-Control": []string{"no-cache"}}
 // applyOverrides applies the transport's request overrides to req. If any
 // overrides apply, req is cloned and the overrides are applied to the clone.
 func (t *RequestModifyingTransport) applyOverrides(req *http.Request) *http.Request {
-	// Only override GET and HEAD requests, just to be safe. We may want to
-	// revisit this constraint later.
-	if method := strings.ToUpper(req.Method); method != "GET" && method != "HEAD" {
-		return req
-	}
-
 	requestURI := req.URL.RequestURI()
+	method := strings.ToUpper(req.Method)
 
 	t.overridesMu.Lock()
 	defer t.overridesMu.Unlock()
+	t.removeExpired(time.Now())
 
 	cloned := false
-	for requestURIRegexp, override := range t.overrides {
-		if requestURIRegexp.MatchString(requestURI) {
+	applied := t.overrides[:0:0]
+	for _, o := range t.overrides {
+		if o.RequestURI.MatchString(requestURI) && o.Rule.matches(method, req.URL.Host) {
 			if !cloned {
 				req = cloneRequest(req)
+				u := *req.URL
+				req.URL = &u
 				cloned = true
 			}
 
-			for name, val := range override.setHeaders {
-				req.Header[textproto.CanonicalMIMEHeaderKey(name)] = val
-			}
+			o.Rule.apply(req)
+			o.Uses++
+			applied = append(applied, o)
 
-			if override.runOnlyOnce {
-				delete(t.overrides, requestURIRegexp)
+			if t.OnOverride != nil {
+				t.OnOverride(req, o.RequestURI)
 			}
 		}
 	}
+	for _, o := range applied {
+		if o.Rule.RunOnlyOnce || (o.Rule.MaxUses > 0 && o.Uses >= o.Rule.MaxUses) {
+			t.remove(o)
+		}
+	}
 
 	return req
 }
+
+// matches returns true if the rule applies to requests with the given method
+// (in upper case) and host.
+func (r *RequestRule) matches(method, host string) bool {
+	if r.Host != nil && !r.Host.MatchString(host) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		// Only override GET and HEAD requests by default, just to be safe.
+		return method == "GET" || method == "HEAD"
+	}
+	for _, m := range r.Methods {
+		if strings.ToUpper(m) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// apply modifies req (which must not be shared) as described by the rule.
+func (r *RequestRule) apply(req *http.Request) {
+	for _, name := range r.DeleteHeaders {
+		req.Header.Del(name)
+	}
+	for name, val := range r.SetHeaders {
+		req.Header[textproto.CanonicalMIMEHeaderKey(name)] = append([]string(nil), val...)
+	}
+	for name, vals := range r.AddHeaders {
+		for _, v := range vals {
+			req.Header.Add(name, v)
+		}
+	}
+
+	if len(r.DeleteQuery) > 0 || len(r.SetQuery) > 0 {
+		q := req.URL.Query()
+		for _, name := range r.DeleteQuery {
+			q.Del(name)
+		}
+		for name, vals := range r.SetQuery {
+			q[name] = vals
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+
+	if r.RewritePath != nil {
+		escaped := r.RewritePath.ReplaceAllString(req.URL.EscapedPath(), r.PathReplacement)
+		if path, err := url.PathUnescape(escaped); err == nil {
+			req.URL.Path, req.URL.RawPath = path, escaped
+		}
+	}
+
+	if r.SetHost != "" {
+		req.URL.Host = r.SetHost
+		req.Host = ""
+	}
+}
@@ -2,8 +2,11 @@ package apiproxy
 
 import (
 	"net/http"
+	"net/url"
+	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestRequestModifyingTransport_NonOverridden(t *testing.T) {
@@ -112,3 +115,220 @@ func TestRequestModifyingTransport_GET_HEAD_Only(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestModifyingTransport_OnOverride(t *testing.T) {
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{}
+
+	var applied []string
+	transport := &RequestModifyingTransport{
+		Transport: mockTransport,
+		OnOverride: func(req *http.Request, requestURI *regexp.Regexp) {
+			applied = append(applied, requestURI.String())
+		},
+	}
+	transport.Override(regexp.MustCompile(`^/foo$`), http.Header{"X-Foo": []string{"bar"}}, false)
+
+	for _, url := range []string{"http://example.com/foo", "http://example.com/bar"} {
+		if _, err := transport.RoundTrip(newHTTPGETRequest(t, url)); err != nil {
+			t.Error("RoundTrip", err)
+		}
+	}
+	if len(applied) != 1 || applied[0] != `^/foo$` {
+		t.Errorf("want OnOverride called once with ^/foo$, got %v", applied)
+	}
+}
+
+func TestRequestModifyingTransport_AddRule(t *testing.T) {
+	tests := []struct {
+		method  string
+		url     string
+		rule    RequestRule
+		wantURL string
+		wantHdr http.Header
+	}{
+		{
+			method:  "GET",
+			url:     "http://example.com/foo",
+			rule:    RequestRule{DeleteHeaders: []string{"X-Old"}, AddHeaders: http.Header{"Accept": []string{"text/plain"}}},
+			wantURL: "http://example.com/foo",
+			wantHdr: http.Header{"Accept": []string{"application/json", "text/plain"}},
+		},
+		{
+			method:  "GET",
+			url:     "http://example.com/foo?a=1&b=2",
+			rule:    RequestRule{DeleteQuery: []string{"a"}, SetQuery: url.Values{"b": []string{"3"}, "c": []string{"4"}}},
+			wantURL: "http://example.com/foo?b=3&c=4",
+		},
+		{
+			method:  "GET",
+			url:     "http://example.com/foo/a%2Fb",
+			rule:    RequestRule{RewritePath: regexp.MustCompile(`^/foo/`), PathReplacement: "/v2/foo/"},
+			wantURL: "http://example.com/v2/foo/a%2Fb",
+		},
+		{
+			method:  "GET",
+			url:     "http://example.com/foo",
+			rule:    RequestRule{SetHost: "internal.example.com:8080"},
+			wantURL: "http://internal.example.com:8080/foo",
+		},
+		{
+			method:  "GET",
+			url:     "http://other.example.com/foo",
+			rule:    RequestRule{Host: regexp.MustCompile(`^example\.com$`), SetHost: "internal.example.com"},
+			wantURL: "http://other.example.com/foo",
+		},
+		{
+			method:  "POST",
+			url:     "http://example.com/foo",
+			rule:    RequestRule{SetHost: "internal.example.com"},
+			wantURL: "http://example.com/foo",
+		},
+		{
+			method:  "POST",
+			url:     "http://example.com/foo",
+			rule:    RequestRule{Methods: []string{"post"}, SetHost: "internal.example.com"},
+			wantURL: "http://internal.example.com/foo",
+		},
+	}
+	for _, test := range tests {
+		mockTransport := newMockTransport()
+		mockTransport.defaultResponse = &http.Response{}
+
+		transport := &RequestModifyingTransport{Transport: mockTransport}
+		transport.AddRule(regexp.MustCompile(`^/foo`), test.rule)
+
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal("http.NewRequest", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Old", "1")
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Error("RoundTrip", err)
+		}
+
+		got := mockTransport.requests[0]
+		if got.URL.String() != test.wantURL {
+			t.Errorf("%s %s: want URL %q, got %q", test.method, test.url, test.wantURL, got.URL)
+		}
+		for name, want := range test.wantHdr {
+			if !reflect.DeepEqual(want, got.Header[name]) {
+				t.Errorf("%s %s: want %s header %q, got %q", test.method, test.url, name, want, got.Header[name])
+			}
+		}
+		if test.rule.DeleteHeaders != nil && got.Header.Get("X-Old") != "" {
+			t.Errorf("%s %s: want X-Old header deleted", test.method, test.url)
+		}
+		if req.URL.String() != test.url || req.Header.Get("X-Old") == "" {
+			t.Errorf("%s %s: original request was modified", test.method, test.url)
+		}
+	}
+}
+
+func TestRequestModifyingTransport_Priority(t *testing.T) {
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{}
+
+	// Later rules overwrite the headers set by earlier ones, so the header
+	// value shows which was applied last.
+	transport := &RequestModifyingTransport{Transport: mockTransport}
+	transport.AddRule(regexp.MustCompile(`^/foo`), RequestRule{SetHeaders: http.Header{"X-Foo": []string{"low"}}, Priority: -1})
+	transport.AddRule(regexp.MustCompile(`^/fo`), RequestRule{SetHeaders: http.Header{"X-Foo": []string{"high"}}, Priority: 1})
+	transport.AddRule(regexp.MustCompile(`^/f`), RequestRule{SetHeaders: http.Header{"X-Foo": []string{"default"}}})
+
+	var order []string
+	for _, o := range transport.List() {
+		order = append(order, o.RequestURI.String())
+	}
+	if want := []string{`^/foo`, `^/f`, `^/fo`}; !reflect.DeepEqual(want, order) {
+		t.Errorf("want rules in order %v, got %v", want, order)
+	}
+
+	if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/foo")); err != nil {
+		t.Error("RoundTrip", err)
+	}
+	if want, got := "high", mockTransport.requests[0].Header.Get("X-Foo"); want != got {
+		t.Errorf("want X-Foo header %q, got %q", want, got)
+	}
+}
+
+func TestRequestModifyingTransport_Expiration(t *testing.T) {
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{}
+
+	transport := &RequestModifyingTransport{Transport: mockTransport}
+	removed := transport.Override(regexp.MustCompile(`^/removed$`), NoCache, false)
+	transport.AddRule(regexp.MustCompile(`^/twice$`), RequestRule{SetHeaders: NoCache, MaxUses: 2})
+	transport.AddRule(regexp.MustCompile(`^/expired$`), RequestRule{SetHeaders: NoCache, Expires: time.Now().Add(-time.Second)})
+	transport.AddRule(regexp.MustCompile(`^/later$`), RequestRule{SetHeaders: NoCache, Expires: time.Now().Add(time.Hour)})
+
+	if !removed.Remove() {
+		t.Error("want Remove to return true")
+	}
+	if removed.Remove() {
+		t.Error("want second Remove to return false")
+	}
+
+	tests := []struct {
+		path      string
+		overrides bool
+	}{
+		{"/removed", false},
+		{"/twice", true},
+		{"/twice", true},
+		{"/twice", false},
+		{"/expired", false},
+		{"/later", true},
+	}
+	for i, test := range tests {
+		if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com"+test.path)); err != nil {
+			t.Error("RoundTrip", err)
+		}
+		if got := mockTransport.requests[i].Header.Get("Cache-Control") != ""; test.overrides != got {
+			t.Errorf("%d: %s: want override applied == %v, got %v", i, test.path, test.overrides, got)
+		}
+	}
+
+	list := transport.List()
+	if len(list) != 1 || list[0].RequestURI.String() != `^/later$` || list[0].Uses != 1 {
+		t.Errorf("want only ^/later$ (used once) remaining, got %+v", list)
+	}
+}
+
+func TestRequestModifyingTransport_Replace(t *testing.T) {
+	transport := &RequestModifyingTransport{}
+	old := transport.Override(regexp.MustCompile(`^/old$`), NoCache, false)
+	handles := transport.Replace([]RequestOverride{
+		{RequestURI: regexp.MustCompile(`^/a$`), Rule: RequestRule{SetHeaders: NoCache}},
+		{RequestURI: regexp.MustCompile(`^/b$`), Rule: RequestRule{SetHeaders: NoCache}},
+	})
+	if old.Remove() {
+		t.Error("want replaced rule to be gone")
+	}
+	if len(handles) != 2 || !handles[0].Remove() {
+		t.Error("want handles for new rules")
+	}
+	if list := transport.List(); len(list) != 1 || list[0].RequestURI.String() != `^/b$` {
+		t.Errorf("want only ^/b$ remaining, got %+v", list)
+	}
+}
+
+func TestRequestRule_SetHeadersNotAliased(t *testing.T) {
+	rule := &RequestRule{
+		SetHeaders: http.Header{"Accept": make([]string, 1, 2)},
+		AddHeaders: http.Header{"Accept": []string{"text/plain"}},
+	}
+	rule.SetHeaders["Accept"][0] = "application/json"
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	rule.apply(req)
+	req.Header["Accept"][0] = "text/html"
+
+	// Neither the Add nor the later edit may write through to the rule.
+	if want, got := []string{"application/json"}, rule.SetHeaders["Accept"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("want rule SetHeaders %q, got %q", want, got)
+	}
+	if got := rule.SetHeaders["Accept"][:2][1]; got != "" {
+		t.Errorf("want rule SetHeaders backing array untouched, got %q", got)
+	}
+}
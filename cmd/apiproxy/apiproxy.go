@@ -1,21 +1,175 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/gorilla/handlers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sourcegraph/apiproxy"
+	"github.com/sourcegraph/apiproxy/accesslog"
+	"github.com/sourcegraph/apiproxy/metrics"
+	"github.com/sourcegraph/apiproxy/service/github"
+	"github.com/sourcegraph/apiproxy/service/gitlab"
+	"github.com/sourcegraph/apiproxy/service/gomod"
+	"github.com/sourcegraph/apiproxy/service/npm"
+	"github.com/sourcegraph/apiproxy/service/oci"
+	"github.com/sourcegraph/apiproxy/service/pypi"
+	"github.com/sourcegraph/apiproxy/tracing"
 	"github.com/sourcegraph/httpcache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var bindAddr = flag.String("http", ":8080", "HTTP bind address for proxy")
+var bindAddr = flag.String("http", ":8080", "HTTP bind address for proxy: a TCP address, unix:/path/to/socket, or systemd (for systemd socket activation)")
+var tlsCert = flag.String("tls-cert", "", "if set (with -tls-key), serve HTTPS using the certificate in this PEM file (reloaded when it changes)")
+var tlsKey = flag.String("tls-key", "", "PEM file containing the private key for -tls-cert")
+var tlsClientCA = flag.String("tls-client-ca", "", "if set, require clients to present a TLS certificate signed by a CA in this PEM file (clients are then identified by their certificate subject for -rate-limit-client, and responses are cached separately for each client)")
+var readTimeout = flag.Duration("read-timeout", 30*time.Second, "maximum duration for reading a client request, including the body (0 for no timeout)")
+var writeTimeout = flag.Duration("write-timeout", 0, "maximum duration for writing a response, from the end of the request headers (0 for no timeout)")
+var idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "how long to keep idle client connections open (0 for no timeout)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "on SIGTERM or SIGINT, how long to wait for in-flight requests to finish before exiting")
+var drainDelay = flag.Duration("drain-delay", 0, "on SIGTERM or SIGINT, how long to keep serving (with the -ready-path endpoint failing) before shutting down, so that load balancers stop sending requests")
+var readyPath = flag.String("ready-path", "", "if set, serve a readiness check at this path on the proxy (e.g., /_apiproxy/ready), which fails once shutdown begins")
 var neverRevalidate = flag.Bool("never-revalidate", false, "never revalidate cached responses (use them regardless of age)")
 var onlyRevalOlderThanStr = flag.String("only-revalidate-older-than", "", "only revalidate cached responses older than this duration (extends cache duration)")
+var forceTTL = flag.Duration("force-ttl", 0, "if set, cache successful responses for this long regardless of the upstream server's Cache-Control headers, synthesizing ETags for responses without one (so they can be revalidated)")
+var forceTTLPath = flag.String("force-ttl-path", "", "if set, only apply -force-ttl to request paths matching this regexp")
+var negativeTTL = flag.Duration("negative-ttl", 0, "if set, cache 404 and 410 responses for this long (e.g., for probes of nonexistent resources)")
+var negativeRateLimitTTL = flag.Duration("negative-ttl-rate-limit", 0, "if set, cache rate-limit responses (429, and 403 with Retry-After or X-RateLimit-Remaining: 0) for this long (or until Retry-After, if sooner)")
+var negativeServerErrorTTL = flag.Duration("negative-ttl-5xx", 0, "if set, cache 5xx responses for this long")
+var serviceName = flag.String("service", "", "use the cache max-age preset for a known API service (github, gitlab, gomod, npm, oci, pypi)")
+var blobDir = flag.String("blob-dir", filepath.Join(os.TempDir(), "apiproxy-blobs"), "directory in which to store registry blobs (with -service=oci)")
+
+var upstreamCA = flag.String("upstream-ca", "", "PEM file of additional CA certificates to trust for the upstream server")
+var upstreamCert = flag.String("upstream-cert", "", "PEM file of a client certificate to present to the upstream server (with -upstream-key)")
+var upstreamKey = flag.String("upstream-key", "", "PEM file of the private key for -upstream-cert")
+var upstreamInsecure = flag.Bool("upstream-insecure", false, "don't verify the upstream server's certificate (for development only)")
+var upstreamHTTP2 = flag.Bool("upstream-http2", true, "use HTTP/2 with the upstream server if it supports it")
+var upstreamMaxIdleConns = flag.Int("upstream-max-idle-conns", 0, "maximum number of idle connections to keep open to the upstream server (0 for the Go default)")
+var upstreamDialTimeout = flag.Duration("upstream-dial-timeout", 30*time.Second, "timeout for connecting to the upstream server")
+var upstreamTLSTimeout = flag.Duration("upstream-tls-timeout", 10*time.Second, "timeout for the TLS handshake with the upstream server")
+var upstreamResponseTimeout = flag.Duration("upstream-response-timeout", 0, "timeout for receiving response headers from the upstream server (0 for no timeout)")
+var upstreamProxy = flag.String("upstream-proxy", "", "URL of a proxy for upstream requests (by default, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used)")
+
+var retries = flag.Int("retries", 0, "if positive, the number of times to retry idempotent upstream requests that fail with a connection error or a 429, 502, 503 or 504 response")
+var retryMaxWait = flag.Duration("retry-max-wait", 30*time.Second, "don't retry upstream requests after this long (from the first attempt)")
+var circuitThreshold = flag.Int("circuit-threshold", 0, "if set, open an upstream circuit (failing fast, serving stale cached responses if possible) after this many consecutive failures")
+var circuitOpenTimeout = flag.Duration("circuit-open-timeout", 30*time.Second, "how long an upstream circuit stays open before a probe request is sent")
+var circuitPath = flag.String("circuit-path", "", "if set, serve the status of upstream circuits as JSON at this path on the proxy (e.g., /_apiproxy/circuits)")
+var rateLimit = flag.Float64("rate-limit", 0, "if set, limit upstream requests to this many per second (cache hits are not limited)")
+var rateLimitRoute = flag.Float64("rate-limit-route", 0, "if set, limit upstream requests for each of the -service preset's routes to this many per second")
+var rateLimitClient = flag.Float64("rate-limit-client", 0, "if set, limit upstream requests by each client (identified by its TLS client certificate or Authorization header) to this many per second")
+var rateLimitBurst = flag.Int("rate-limit-burst", 10, "number of requests allowed in a burst by each rate limit")
+var rateLimitMaxWait = flag.Duration("rate-limit-max-wait", 5*time.Second, "maximum time a rate-limited request waits before being rejected with 429 Too Many Requests")
+
+var metricsPath = flag.String("metrics-path", "", "if set, serve Prometheus metrics at this path on the proxy (e.g., /metrics)")
+var traceExporter = flag.String("trace", "", "if set, trace requests with OpenTelemetry and export spans to stdout (on stderr) or otlp (configured by OTEL_EXPORTER_OTLP_* environment variables)")
+var statsPath = flag.String("stats-path", "", "if set, serve cache hit/revalidation/fetch counts as JSON at this path on the proxy (e.g., /_apiproxy/stats)")
+
+var logFormat = flag.String("log", "combined", "access log format: combined (Apache Combined Log Format), json (structured, with cache outcome and upstream latency), or none")
+var logSampleRate = flag.Float64("log-sample-rate", 1, "fraction of requests to log with -log=json (5xx responses are always logged)")
+var logRedact = flag.String("log-redact", "", "comma-separated additional headers and query parameters to redact with -log=json (Authorization, Cookie, access_token, etc. are always redacted)")
+var logHeaders = flag.Bool("log-headers", false, "log request headers with -log=json")
+
+// service is a preset for a known API service.
+type service struct {
+	// check determines whether cache entries are still valid.
+	check apiproxy.Validator
+
+	// patterns are the path regexps that cache stats are grouped by.
+	patterns []*regexp.Regexp
+
+	// upstream is the transport used to send requests to the target (e.g.,
+	// to authenticate them). If nil, the transport configured by the
+	// -upstream-* flags is used.
+	upstream http.RoundTripper
+
+	// wrap, if non-nil, wraps the proxy's caching transport. upstream sends
+	// requests through upstream (with retries, rate limits and the circuit
+	// breaker) without caching them.
+	wrap func(t, upstream http.RoundTripper) http.RoundTripper
+}
+
+// services maps preset names (for the -service flag) to functions that return
+// the preset for the API served at the target URL, given the transport for
+// upstream requests.
+var services = map[string]func(target *url.URL, upstream http.RoundTripper) service{
+	"github": func(target *url.URL, upstream http.RoundTripper) service {
+		// The reverse proxy prepends the target path to request paths, so a
+		// target of https://github.example.com/api/v3 yields GitHub Enterprise
+		// API paths.
+		maxAge := &githubproxy.MaxAge{
+			User:         time.Hour * 24,
+			Repository:   time.Hour * 24,
+			Repositories: time.Hour * 24,
+			Activity:     time.Hour * 12,
+			BasePath:     target.Path,
+		}
+		return service{check: maxAge.Validator(), patterns: maxAge.Patterns()}
+	},
+	"gitlab": func(target *url.URL, upstream http.RoundTripper) service {
+		// As with GitHub Enterprise, a target of
+		// https://gitlab.example.com/api/v4 yields GitLab API paths, and an
+		// empty target path means the default API path.
+		maxAge := &gitlabproxy.MaxAge{
+			Project:         time.Hour * 24,
+			User:            time.Hour * 24,
+			MergeRequests:   time.Minute * 5,
+			Pipelines:       time.Minute,
+			RepositoryFiles: time.Hour,
+			Commits:         time.Minute * 5,
+			BasePath:        target.Path,
+		}
+		return service{check: maxAge.Validator(), patterns: maxAge.Patterns()}
+	},
+	"gomod": func(target *url.URL, upstream http.RoundTripper) service {
+		maxAge := &gomodproxy.MaxAge{List: time.Minute * 5, BasePath: target.Path}
+		return service{check: maxAge.Validator(), patterns: maxAge.Patterns()}
+	},
+	"npm": func(target *url.URL, upstream http.RoundTripper) service {
+		maxAge := &npmproxy.MaxAge{Metadata: time.Minute * 5, BasePath: target.Path}
+		return service{check: maxAge.Validator(), patterns: maxAge.Patterns()}
+	},
+	"oci": func(target *url.URL, upstream http.RoundTripper) service {
+		maxAge := &ociproxy.MaxAge{Tag: time.Minute}
+		token := &ociproxy.TokenTransport{
+			Username:  os.Getenv("APIPROXY_REGISTRY_USERNAME"),
+			Password:  os.Getenv("APIPROXY_REGISTRY_PASSWORD"),
+			Transport: upstream,
+		}
+		return service{
+			check:    maxAge.Validator(),
+			patterns: maxAge.Patterns(),
+			upstream: token,
+			wrap: func(t, tokenUpstream http.RoundTripper) http.RoundTripper {
+				// Serve blobs from disk, bypassing the in-memory cache. CDN
+				// redirects are followed without registry credentials.
+				return &ociproxy.BlobTransport{Dir: *blobDir, Blobs: tokenUpstream, Redirects: upstream, Transport: t}
+			},
+		}
+	},
+	"pypi": func(target *url.URL, upstream http.RoundTripper) service {
+		maxAge := &pypiproxy.MaxAge{Index: time.Minute * 5, JSON: time.Minute * 5, BasePath: target.Path}
+		return service{check: maxAge.Validator(), patterns: maxAge.Patterns()}
+	},
+}
 
 func main() {
 	flag.Usage = func() {
@@ -34,6 +188,17 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -never-revalidate http://example.com\n\n")
 		fmt.Fprintf(os.Stderr, "\t... and only revalidate cached responses older than an hour:\n")
 		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -only-revalidate-older-than=1h http://example.com\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo proxy a GitHub Enterprise API with GitHub cache max-ages:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -service=github https://github.example.com/api/v3\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo run a pull-through cache of the Go module proxy (immutable module files are never revalidated):\n")
+		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -service=gomod https://proxy.golang.org\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo run a pull-through cache of Docker Hub (set APIPROXY_REGISTRY_USERNAME and\n")
+		fmt.Fprintf(os.Stderr, "\tAPIPROXY_REGISTRY_PASSWORD to authenticate):\n")
+		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -service=oci https://registry-1.docker.io\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo serve HTTPS only to clients with certificates signed by a CA:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -tls-cert=cert.pem -tls-key=key.pem -tls-client-ca=ca.pem http://example.com\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo serve on a Unix socket, with a readiness check, and drain for up to a minute on SIGTERM:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ apiproxy -http=unix:/run/apiproxy.sock -ready-path=/_apiproxy/ready -shutdown-timeout=1m http://example.com\n\n")
 		fmt.Fprintln(os.Stderr)
 		os.Exit(1)
 	}
@@ -57,25 +222,306 @@ func main() {
 		}
 	}
 
-	proxy := apiproxy.NewCachingSingleHostReverseProxy(targetURL, httpcache.NewMemoryCache())
+	upstreamOpt := &apiproxy.UpstreamOptions{
+		CAFile:                *upstreamCA,
+		CertFile:              *upstreamCert,
+		KeyFile:               *upstreamKey,
+		InsecureSkipVerify:    *upstreamInsecure,
+		DisableHTTP2:          !*upstreamHTTP2,
+		MaxIdleConnsPerHost:   *upstreamMaxIdleConns,
+		DialTimeout:           *upstreamDialTimeout,
+		TLSHandshakeTimeout:   *upstreamTLSTimeout,
+		ResponseHeaderTimeout: *upstreamResponseTimeout,
+	}
+	if *upstreamProxy != "" {
+		if upstreamOpt.Proxy, err = url.Parse(*upstreamProxy); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing upstream proxy URL %q: %s\n", *upstreamProxy, err)
+			os.Exit(1)
+		}
+	}
+	upstreamTransport, err := upstreamOpt.Transport()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure upstream connections: %s\n", err)
+		os.Exit(1)
+	}
+
+	svc := service{upstream: upstreamTransport}
+	if *serviceName != "" {
+		newService, present := services[*serviceName]
+		if !present {
+			fmt.Fprintf(os.Stderr, "Unknown service %q\n", *serviceName)
+			os.Exit(1)
+		}
+		svc = newService(targetURL, upstreamTransport)
+		if svc.upstream == nil {
+			svc.upstream = upstreamTransport
+		}
+	}
+	stats := &apiproxy.CacheStats{Patterns: svc.patterns}
+
+	cache := httpcache.NewMemoryCache()
+	var identity func(req *http.Request) string
+	if *tlsClientCA != "" {
+		// Don't serve one client's responses to another.
+		identity = apiproxy.ClientIdentity
+	}
+	proxy := apiproxy.NewPartitionedCachingSingleHostReverseProxy(targetURL, cache, identity)
 	cachingTransport := proxy.Transport.(*httpcache.Transport)
-	cachingTransport.Transport = &apiproxy.RevalidationTransport{
-		Check: apiproxy.ValidatorFunc(func(url *url.URL, age time.Duration) bool {
-			if *neverRevalidate {
-				return true
-			}
-			if *onlyRevalOlderThanStr != "" {
-				return age <= onlyRevalOlderThan
+	var check apiproxy.Validator = apiproxy.ValidatorFunc(func(url *url.URL, age time.Duration) bool {
+		if *neverRevalidate {
+			return true
+		}
+		if svc.check != nil && svc.check.Valid(url, age) {
+			return true
+		}
+		if *onlyRevalOlderThanStr != "" {
+			return age <= onlyRevalOlderThan
+		}
+		return false
+	})
+	if rule, ok := svc.check.(apiproxy.ValidatorRule); ok {
+		// Report the preset's rules in Cache-Status headers and access logs.
+		check = ruleValidator{check, rule}
+	}
+	retry := func(t http.RoundTripper) http.RoundTripper {
+		if *retries <= 0 {
+			return t
+		}
+		return &apiproxy.RetryTransport{MaxRetries: *retries, MaxElapsed: *retryMaxWait, Transport: t}
+	}
+	var breaker *apiproxy.CircuitBreakerTransport
+	if *circuitThreshold > 0 {
+		breaker = &apiproxy.CircuitBreakerTransport{
+			Patterns:         svc.patterns,
+			FailureThreshold: *circuitThreshold,
+			OpenTimeout:      *circuitOpenTimeout,
+			OpenStatusCode:   http.StatusServiceUnavailable,
+			Cache:            cache,
+		}
+	}
+	var limiter *apiproxy.RateLimitTransport
+	if *rateLimit > 0 || *rateLimitRoute > 0 || *rateLimitClient > 0 {
+		limiter = &apiproxy.RateLimitTransport{
+			Host:     apiproxy.RateLimit{Rate: *rateLimit, Burst: *rateLimitBurst},
+			Client:   apiproxy.RateLimit{Rate: *rateLimitClient, Burst: *rateLimitBurst},
+			MaxWait:  *rateLimitMaxWait,
+			Identity: apiproxy.ClientIdentity,
+		}
+		for _, pattern := range svc.patterns {
+			limiter.Routes = append(limiter.Routes, apiproxy.RouteRateLimit{
+				Pattern: pattern,
+				Limit:   apiproxy.RateLimit{Rate: *rateLimitRoute, Burst: *rateLimitBurst},
+			})
+		}
+	}
+	var tp *sdktrace.TracerProvider
+	var tracer *tracing.Tracer
+	upstream := svc.upstream
+	if *traceExporter != "" {
+		tp, err = newTracerProvider(*traceExporter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up tracing: %s\n", err)
+			os.Exit(1)
+		}
+		tracer = tracing.New(tp)
+		tracer.InstrumentCacheStats(stats)
+		upstream = tracer.UpstreamTransport(upstream)
+	}
+	// Retries go through the rate limiter, like first attempts.
+	if limiter != nil {
+		limiter.Transport = upstream
+		upstream = limiter
+	}
+	upstream = stats.UpstreamTransport(retry(upstream))
+	if breaker != nil {
+		breaker.Transport = upstream
+		upstream = breaker
+	}
+	var policies []apiproxy.CachePolicy
+	if *forceTTL > 0 {
+		pattern, err := regexp.Compile(*forceTTLPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing -force-ttl-path regexp %q: %s\n", *forceTTLPath, err)
+			os.Exit(1)
+		}
+		policies = append(policies, apiproxy.CachePolicy{Pattern: pattern, TTL: *forceTTL})
+	}
+	var negativePolicies []apiproxy.NegativeCachePolicy
+	var negativeCheck apiproxy.Validator
+	if *negativeTTL > 0 || *negativeRateLimitTTL > 0 || *negativeServerErrorTTL > 0 {
+		negativePolicies = append(negativePolicies, apiproxy.NegativeCachePolicy{
+			Pattern:        regexp.MustCompile(""),
+			TTL:            *negativeTTL,
+			RateLimitTTL:   *negativeRateLimitTTL,
+			ServerErrorTTL: *negativeServerErrorTTL,
+		})
+		// Cached error responses expire after their TTL, regardless of the
+		// service preset's max-ages.
+		negativeCheck = apiproxy.ValidatorFunc(func(*url.URL, time.Duration) bool { return false })
+	}
+	cached := upstream
+	if len(policies) > 0 || len(negativePolicies) > 0 {
+		cached = &apiproxy.CachePolicyTransport{
+			Policies:         policies,
+			NegativePolicies: negativePolicies,
+			Transport:        upstream,
+		}
+	}
+	revalidationTransport := &apiproxy.RevalidationTransport{
+		Check:         check,
+		NegativeCheck: negativeCheck,
+		Transport:     cached,
+		Cache:         cache,
+	}
+	cachingTransport.Transport = revalidationTransport
+	proxy.Transport = stats.Transport(cachingTransport)
+	if svc.wrap != nil {
+		proxy.Transport = svc.wrap(proxy.Transport, upstream)
+	}
+	if tracer != nil {
+		tracer.InstrumentRevalidationTransport(revalidationTransport)
+		proxy.Transport = tracer.Transport(proxy.Transport)
+	}
+
+	if *metricsPath != "" {
+		reg := prometheus.NewRegistry()
+		m := metrics.New(reg)
+		m.InstrumentCacheStats(stats)
+		m.InstrumentRevalidationTransport(revalidationTransport, stats)
+		if breaker != nil {
+			m.InstrumentCircuitBreakerTransport(breaker)
+		}
+		http.Handle(*metricsPath, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	}
+	if *statsPath != "" {
+		http.Handle(*statsPath, stats)
+	}
+	if *circuitPath != "" && breaker != nil {
+		http.Handle(*circuitPath, breaker)
+	}
+	switch *logFormat {
+	case "combined":
+		http.Handle("/", handlers.CombinedLoggingHandler(os.Stdout, proxy))
+	case "json":
+		logger := accesslog.New(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+		logger.SampleRate = *logSampleRate
+		logger.Headers = *logHeaders
+		if *logRedact != "" {
+			for _, name := range strings.Split(*logRedact, ",") {
+				name = strings.TrimSpace(name)
+				logger.RedactHeaders = append(logger.RedactHeaders, name)
+				logger.RedactParams = append(logger.RedactParams, name)
 			}
-			return false
-		}),
+		}
+		logger.InstrumentCacheStats(stats)
+		http.Handle("/", logger.Handler(proxy))
+	case "none":
+		http.Handle("/", proxy)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown log format %q (want combined, json or none)\n", *logFormat)
+		os.Exit(1)
 	}
 
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stdout, proxy))
+	var draining int32
+	if *readyPath != "" {
+		http.HandleFunc(*readyPath, func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&draining) != 0 {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
 
-	fmt.Fprintf(os.Stderr, "Starting proxy on %s with target %s\n", *bindAddr, targetURL.String())
-	err = http.ListenAndServe(*bindAddr, nil)
+	ln, err := listen(*bindAddr)
 	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err)
+		log.Fatalf("Listen: %s", err)
+	}
+	server := &http.Server{
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	if (*tlsCert != "") != (*tlsKey != "") || (*tlsClientCA != "" && *tlsCert == "") {
+		fmt.Fprintf(os.Stderr, "-tls-cert and -tls-key must be used together (and are required by -tls-client-ca)\n")
+		os.Exit(1)
+	}
+	if *tlsCert != "" {
+		server.TLSConfig, err = newServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up TLS: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// On SIGTERM or SIGINT, stop accepting connections and wait for in-flight
+	// requests to finish.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		atomic.StoreInt32(&draining, 1)
+		fmt.Fprintf(os.Stderr, "Shutting down (waiting up to %s for in-flight requests)\n", *drainDelay+*shutdownTimeout)
+		time.Sleep(*drainDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Shutdown: %s\n", err)
+		}
+		if tp != nil {
+			// Draining may have used up ctx, so flushing spans gets its own
+			// deadline.
+			ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "Shutting down tracer: %s\n", err)
+			}
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "Starting proxy on %s with target %s\n", ln.Addr(), targetURL.String())
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("Serve: %s", err)
+	}
+	<-shutdownDone
+}
+
+// tracerShutdownTimeout is how long to wait on shutdown for buffered spans to
+// be exported.
+const tracerShutdownTimeout = 5 * time.Second
+
+// ruleValidator is a Validator whose rules are described by a separate
+// ValidatorRule.
+type ruleValidator struct {
+	apiproxy.Validator
+	apiproxy.ValidatorRule
+}
+
+// newTracerProvider returns an OpenTelemetry tracer provider that exports spans
+// using the named exporter ("stdout" or "otlp").
+func newTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	res := resource.NewSchemaless(attribute.String("service.name", "apiproxy"))
+	switch exporter {
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp), sdktrace.WithResource(res)), nil
+	case "otlp":
+		exp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res)), nil
 	}
+	return nil, fmt.Errorf("unknown trace exporter %q (want stdout or otlp)", exporter)
 }
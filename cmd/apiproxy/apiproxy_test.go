@@ -1,14 +1,18 @@
 package main_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
+	"testing"
 	"time"
 )
 
@@ -49,6 +53,71 @@ func Example() {
 	// Got response: qux (cached: true)
 }
 
+func TestGracefulShutdown(t *testing.T) {
+	// Start a target server that responds slowly.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "apiproxy.sock")
+
+	// Start apiproxy on a Unix socket.
+	cmd := exec.Command(program, "-http=unix:"+socket, "-ready-path=/_ready", target.URL)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	time.Sleep(250 * time.Millisecond)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://apiproxy/_ready")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	resp.Body.Close()
+	if want := http.StatusOK; resp.StatusCode != want {
+		t.Errorf("want readiness status %d, got %d", want, resp.StatusCode)
+	}
+
+	// Send SIGTERM during a request, which should still succeed.
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		resp, err := client.Get("http://apiproxy/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		done <- result{body, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; r.err != nil || string(r.body) != "slow" {
+		t.Errorf("want in-flight request to succeed, got body %q and error %v", r.body, r.err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("want apiproxy to exit cleanly, got %s", err)
+	}
+}
+
 func httpGet(url string) {
 	resp, err := http.Get(url)
 	if err != nil {
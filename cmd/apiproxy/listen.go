@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listen returns a listener for addr, which is a TCP address (e.g., ":8080"),
+// "unix:" followed by the path of a Unix socket, or "systemd" (to use the first
+// socket passed by systemd socket activation).
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return systemdListener()
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		// Remove a stale socket left by a previous process.
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// systemdListenFDsStart is the first file descriptor passed by systemd socket
+// activation (see sd_listen_fds(3)).
+const systemdListenFDsStart = 3
+
+// systemdListener returns a listener for the first socket passed by systemd
+// socket activation.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID is not %d)", os.Getpid())
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS is %q)", os.Getenv("LISTEN_FDS"))
+	}
+	f := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
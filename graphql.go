@@ -0,0 +1,351 @@
+package apiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sourcegraph/httpcache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// GraphQLOperationMaxAge is a map of GraphQL operation names to the maximum age
+// of cached responses to those operations. The empty name applies to
+// anonymous queries.
+type GraphQLOperationMaxAge map[string]time.Duration
+
+// GraphQLCachingTransport is an implementation of net/http.RoundTripper that
+// caches responses to GraphQL queries (such as those sent to GitHub's GraphQL
+// API).
+//
+// GraphQL requests are POSTs, so they are never cached by httpcache. This
+// transport instead keys cache entries on the normalized query document, the
+// variables, the operation name and the identity of the requester. Only
+// queries whose operation name is in MaxAge are cached; mutations,
+// subscriptions and all other requests are passed to the underlying transport.
+type GraphQLCachingTransport struct {
+	// MaxAge determines which queries are cached and for how long.
+	MaxAge GraphQLOperationMaxAge
+
+	// Cache stores query responses. If nil, no responses are cached.
+	Cache httpcache.Cache
+
+	// Identity returns a string identifying the requester, so that responses
+	// are not shared between users with different permissions. If nil, the
+	// request's Authorization header is used.
+	Identity func(req *http.Request) string
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+}
+
+// graphQLRequest is the body of a GraphQL HTTP request.
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *GraphQLCachingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if t.Cache == nil || req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/graphql") || req.Body == nil {
+		return transport.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req2 := *req
+	req2.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req = &req2
+
+	key, maxAge, cacheable := t.cacheKey(req, body)
+	if !cacheable {
+		return transport.RoundTrip(req)
+	}
+
+	if req.Header.Get("Cache-Control") != "no-cache" {
+		if cachedResp := t.cachedResponse(key, req, maxAge); cachedResp != nil {
+			return cachedResp, nil
+		}
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Failing to cache the response doesn't fail the request.
+		t.store(key, resp)
+	}
+	return resp, nil
+}
+
+// cacheKey returns the cache key for the GraphQL request with the given body,
+// and the max-age of its operation. If the request is not a query whose
+// operation is in t.MaxAge, cacheable is false.
+func (t *GraphQLCachingTransport) cacheKey(req *http.Request, body []byte) (key string, maxAge time.Duration, cacheable bool) {
+	var gqlReq graphQLRequest
+	if err := json.Unmarshal(body, &gqlReq); err != nil {
+		return "", 0, false
+	}
+
+	tokens := graphQLTokens(gqlReq.Query)
+	op, found := graphQLOperation(tokens, gqlReq.OperationName)
+	if !found || op.typ != "query" {
+		return "", 0, false
+	}
+	maxAge, cacheable = t.MaxAge[op.name]
+	if !cacheable {
+		return "", 0, false
+	}
+
+	variables, err := canonicalJSON(gqlReq.Variables)
+	if err != nil {
+		return "", 0, false
+	}
+
+	var identity string
+	if t.Identity != nil {
+		identity = t.Identity(req)
+	} else {
+		identity = req.Header.Get("Authorization")
+	}
+
+	h := sha256.New()
+	for _, s := range []string{strings.Join(tokens, " "), string(variables), op.name, identity} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return "graphql:" + req.URL.String() + "#" + hex.EncodeToString(h.Sum(nil)), maxAge, true
+}
+
+// cachedResponse returns the cached response for key, or nil if there is no
+// cached response younger than maxAge.
+func (t *GraphQLCachingTransport) cachedResponse(key string, req *http.Request, maxAge time.Duration) *http.Response {
+	data, present := t.Cache.Get(key)
+	if !present {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		t.Cache.Delete(key)
+		return nil
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil || time.Since(date) > maxAge {
+		resp.Body.Close()
+		t.Cache.Delete(key)
+		return nil
+	}
+	resp.Header.Set(httpcache.XFromCache, "1")
+	return resp
+}
+
+// store caches resp under key unless its body contains GraphQL errors. The
+// response body is read and replaced so that it can still be read by the
+// caller.
+func (t *GraphQLCachingTransport) store(key string, resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		// Let the client read what was received, followed by the error.
+		resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var result struct {
+		Errors json.RawMessage `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || hasGraphQLErrors(result.Errors) {
+		return nil
+	}
+
+	if resp.Header.Get("Date") == "" {
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	data, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return err
+	}
+	t.Cache.Set(key, data)
+	return nil
+}
+
+// hasGraphQLErrors returns true if errors, the value of a GraphQL response's
+// "errors" key, is present and not null or empty.
+func hasGraphQLErrors(errors json.RawMessage) bool {
+	var list []json.RawMessage
+	if err := json.Unmarshal(errors, &list); err == nil {
+		return len(list) > 0
+	}
+	return len(errors) > 0
+}
+
+// errorReader is an io.Reader that always returns err.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// canonicalJSON re-encodes data so that equivalent JSON values (e.g., objects
+// with differently ordered keys) have identical encodings.
+func canonicalJSON(data json.RawMessage) ([]byte, error) {
+	if len(data) == 0 {
+		return []byte("null"), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// graphQLOp is an operation definition in a GraphQL document.
+type graphQLOp struct {
+	typ  string // "query", "mutation" or "subscription"
+	name string
+}
+
+// graphQLOperation returns the operation in the tokenized document that would
+// be executed for the given operation name.
+func graphQLOperation(tokens []string, operationName string) (op graphQLOp, found bool) {
+	var ops []graphQLOp
+	depth, parens := 0, 0
+	expectBody := false
+	for i, tok := range tokens {
+		switch tok {
+		case "(":
+			parens++
+		case ")":
+			parens--
+		case "{":
+			// Braces inside parentheses are object values in variable
+			// defaults or directive arguments, not selection sets.
+			if depth == 0 && parens == 0 {
+				if !expectBody {
+					// Query shorthand, e.g., "{ viewer { login } }".
+					ops = append(ops, graphQLOp{typ: "query"})
+				}
+				expectBody = false
+			}
+			depth++
+		case "}":
+			depth--
+		case "query", "mutation", "subscription", "fragment":
+			if depth == 0 && !expectBody {
+				expectBody = true
+				if tok == "fragment" {
+					continue
+				}
+				op := graphQLOp{typ: tok}
+				if i+1 < len(tokens) && isGraphQLName(tokens[i+1]) {
+					op.name = tokens[i+1]
+				}
+				ops = append(ops, op)
+			}
+		}
+	}
+
+	if operationName == "" {
+		if len(ops) == 1 {
+			return ops[0], true
+		}
+		return graphQLOp{}, false
+	}
+	for _, op := range ops {
+		if op.name == operationName {
+			return op, true
+		}
+	}
+	return graphQLOp{}, false
+}
+
+// graphQLTokens splits a GraphQL document into tokens, discarding comments and
+// insignificant whitespace and commas. Two documents that differ only in
+// formatting have the same tokens.
+func graphQLTokens(doc string) (tokens []string) {
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(doc[i:], `"""`):
+			end := i + 3
+			for end < len(doc) && !strings.HasPrefix(doc[end:], `"""`) {
+				if strings.HasPrefix(doc[end:], `\"""`) {
+					end += 4
+				} else {
+					end++
+				}
+			}
+			end += 3
+			if end > len(doc) {
+				end = len(doc)
+			}
+			tokens = append(tokens, doc[i:end])
+			i = end
+		case c == '"':
+			end := i + 1
+			for end < len(doc) && doc[end] != '"' {
+				if doc[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+			if end > len(doc) {
+				end = len(doc)
+			}
+			tokens = append(tokens, doc[i:end])
+			i = end
+		case strings.HasPrefix(doc[i:], "..."):
+			tokens = append(tokens, "...")
+			i += 3
+		case isGraphQLNameChar(c) || c == '-':
+			// Names and numbers (which may contain '.', '+' and '-', as in
+			// -1.5e+3).
+			number := c == '-' || ('0' <= c && c <= '9')
+			end := i + 1
+			for end < len(doc) && (isGraphQLNameChar(doc[end]) || (number && strings.IndexByte(".+-", doc[end]) != -1)) {
+				end++
+			}
+			tokens = append(tokens, doc[i:end])
+			i = end
+		default:
+			tokens = append(tokens, doc[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+func isGraphQLName(tok string) bool {
+	return tok != "" && isGraphQLNameChar(tok[0]) && (tok[0] < '0' || tok[0] > '9')
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
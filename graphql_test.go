@@ -0,0 +1,162 @@
+package apiproxy
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sourcegraph/httpcache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphQLCachingTransport(t *testing.T) {
+	targetRequestCount := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetRequestCount++
+		w.Write([]byte(`{"data":{"viewer":{"login":"alice"}}}`))
+	}))
+	defer target.Close()
+
+	transport := &GraphQLCachingTransport{
+		MaxAge: GraphQLOperationMaxAge{"Viewer": time.Hour},
+		Cache:  httpcache.NewMemoryCache(),
+	}
+
+	tests := []struct {
+		label         string
+		body          string
+		authorization string
+		cached        bool
+	}{
+		{"first query", `{"query":"query Viewer { viewer { login } }"}`, "token a", false},
+		{"same query", `{"query":"query Viewer { viewer { login } }"}`, "token a", true},
+		{"reformatted query", `{"query":"# comment\nquery Viewer {\n  viewer {\n    login,\n  }\n}"}`, "token a", true},
+		{"different identity", `{"query":"query Viewer { viewer { login } }"}`, "token b", false},
+		{"variables", `{"query":"query Viewer($n: Int) { viewer { login } }","variables":{"n":1,"m":2}}`, "token a", false},
+		{"reordered variables", `{"query":"query Viewer($n: Int) { viewer { login } }","variables":{"m":2,"n":1}}`, "token a", true},
+		{"different variables", `{"query":"query Viewer($n: Int) { viewer { login } }","variables":{"m":2,"n":2}}`, "token a", false},
+		{"operation without max-age", `{"query":"query Other { viewer { login } }"}`, "token a", false},
+		{"operation without max-age again", `{"query":"query Other { viewer { login } }"}`, "token a", false},
+		{"mutation", `{"query":"mutation Viewer { addStar { clientMutationId } }"}`, "token a", false},
+		{"mutation again", `{"query":"mutation Viewer { addStar { clientMutationId } }"}`, "token a", false},
+	}
+	for _, test := range tests {
+		before := targetRequestCount
+		req, err := http.NewRequest("POST", target.URL+"/graphql", bytes.NewReader([]byte(test.body)))
+		if err != nil {
+			t.Fatal("http.NewRequest", err)
+		}
+		req.Header.Set("Authorization", test.authorization)
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: RoundTrip: %s", test.label, err)
+		}
+		if body := readAll(t, resp.Body); len(body) == 0 {
+			t.Errorf("%s: want non-empty response body", test.label)
+		}
+		if cached := targetRequestCount == before; test.cached != cached {
+			t.Errorf("%s: want cached == %v, got %v", test.label, test.cached, cached)
+		}
+		if fromCache := resp.Header.Get(httpcache.XFromCache) != ""; test.cached != fromCache {
+			t.Errorf("%s: want %s header == %v, got %v", test.label, httpcache.XFromCache, test.cached, fromCache)
+		}
+	}
+}
+
+func TestGraphQLCachingTransport_BodyError(t *testing.T) {
+	bodyErr := errors.New("connection reset")
+	targetRequestCount := 0
+	transport := &GraphQLCachingTransport{
+		MaxAge: GraphQLOperationMaxAge{"Viewer": time.Hour},
+		Cache:  httpcache.NewMemoryCache(),
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			targetRequestCount++
+			body := io.MultiReader(strings.NewReader(`{"data":`), errorReader{bodyErr})
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(body), Request: req}, nil
+		}),
+	}
+
+	// The response is returned (and not cached), and reading its body fails.
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "http://example.com/graphql", strings.NewReader(`{"query":"query Viewer { viewer { login } }"}`))
+		if err != nil {
+			t.Fatal("http.NewRequest", err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		if body, err := ioutil.ReadAll(resp.Body); string(body) != `{"data":` || err != bodyErr {
+			t.Errorf("want body %q and error %q, got %q and %v", `{"data":`, bodyErr, body, err)
+		}
+	}
+	if targetRequestCount != 2 {
+		t.Errorf("want 2 target requests, got %d", targetRequestCount)
+	}
+}
+
+func TestGraphQLCachingTransport_Errors(t *testing.T) {
+	tests := []struct {
+		body   string
+		cached bool
+	}{
+		{`{"data":{"viewer":{"login":"alice"}}}`, true},
+		{`{"data":{"viewer":{"login":"alice"}},"errors":null}`, true},
+		{`{"data":{"viewer":{"login":"alice"}},"errors":[]}`, true},
+		{`{"data":null,"errors":[{"message":"rate limited"}]}`, false},
+	}
+	for _, test := range tests {
+		targetRequestCount := 0
+		transport := &GraphQLCachingTransport{
+			MaxAge: GraphQLOperationMaxAge{"Viewer": time.Hour},
+			Cache:  httpcache.NewMemoryCache(),
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				targetRequestCount++
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(test.body)), Request: req}, nil
+			}),
+		}
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("POST", "http://example.com/graphql", strings.NewReader(`{"query":"query Viewer { viewer { login } }"}`))
+			if err != nil {
+				t.Fatal("http.NewRequest", err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal("RoundTrip", err)
+			}
+			readAll(t, resp.Body)
+		}
+		if cached := targetRequestCount == 1; test.cached != cached {
+			t.Errorf("%s: want cached == %v, got %v", test.body, test.cached, cached)
+		}
+	}
+}
+
+func TestGraphQLOperation(t *testing.T) {
+	tests := []struct {
+		doc           string
+		operationName string
+		found         bool
+		op            graphQLOp
+	}{
+		{`{ viewer { login } }`, "", true, graphQLOp{"query", ""}},
+		{`query { viewer { login } }`, "", true, graphQLOp{"query", ""}},
+		{`query Q($a: In = {x: 1}) { viewer { login } }`, "", true, graphQLOp{"query", "Q"}},
+		{`mutation M { addStar { clientMutationId } }`, "", true, graphQLOp{"mutation", "M"}},
+		{`query A { a } mutation B { b }`, "B", true, graphQLOp{"mutation", "B"}},
+		{`query A { a } mutation B { b }`, "", false, graphQLOp{}},
+		{`query A { ...F } fragment F on Query { query }`, "", true, graphQLOp{"query", "A"}},
+		{`query A { a }`, "C", false, graphQLOp{}},
+	}
+	for _, test := range tests {
+		op, found := graphQLOperation(graphQLTokens(test.doc), test.operationName)
+		if test.found != found || test.op != op {
+			t.Errorf("%q (operation %q): want %+v (found == %v), got %+v (found == %v)", test.doc, test.operationName, test.op, test.found, op, found)
+		}
+	}
+}
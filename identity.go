@@ -0,0 +1,18 @@
+package apiproxy
+
+import (
+	"net/http"
+)
+
+// ClientIdentity returns a string identifying the client that made req: the
+// subject of its verified TLS client certificate (when the proxy requires
+// mutual TLS), or else its Authorization header. It can be used as the Identity
+// of GraphQLCachingTransport and RateLimitTransport, whose requests (when made
+// by a reverse proxy) carry the TLS state of the client's connection, and to
+// partition the cache of NewPartitionedCachingSingleHostReverseProxy.
+func ClientIdentity(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		return "cert:" + req.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return req.Header.Get("Authorization")
+}
@@ -0,0 +1,32 @@
+package apiproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestClientIdentity(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}}}
+	tests := []struct {
+		tls           *tls.ConnectionState
+		authorization string
+		want          string
+	}{
+		{nil, "", ""},
+		{nil, "token abc", "token abc"},
+		{&tls.ConnectionState{}, "token abc", "token abc"},
+		{&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "token abc", "cert:CN=alice,O=Example"},
+	}
+	for i, test := range tests {
+		req := newHTTPGETRequest(t, "https://example.com")
+		req.TLS = test.tls
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		if got := ClientIdentity(req); test.want != got {
+			t.Errorf("%d: want identity %q, got %q", i, test.want, got)
+		}
+	}
+}
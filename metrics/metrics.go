@@ -0,0 +1,144 @@
+// Package metrics exposes Prometheus metrics for apiproxy's transports.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sourcegraph/apiproxy"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Metrics are the Prometheus metrics for apiproxy's transports. Use the
+// Instrument methods to set the hooks that update them.
+type Metrics struct {
+	// Requests counts requests served through a caching transport, by route
+	// pattern, cache outcome and upstream status.
+	Requests *prometheus.CounterVec
+
+	// RequestDuration observes the time taken to serve requests through a
+	// caching transport, by route pattern and cache outcome.
+	RequestDuration *prometheus.HistogramVec
+
+	// UpstreamDuration observes the time taken by upstream requests, by route
+	// pattern and upstream status.
+	UpstreamDuration *prometheus.HistogramVec
+
+	// RevalidationChecks counts RevalidationTransport Validator checks, by
+	// route pattern and result ("valid" checks synthesize 304 responses).
+	RevalidationChecks *prometheus.CounterVec
+
+	// Overrides counts RequestModifyingTransport overrides applied, by request
+	// URI pattern.
+	Overrides *prometheus.CounterVec
+
+	// CircuitState is the state of each CircuitBreakerTransport circuit
+	// (0 = closed, 1 = open, 2 = half-open).
+	CircuitState *prometheus.GaugeVec
+}
+
+// New creates the metrics and registers them with reg (if reg is non-nil).
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiproxy",
+			Name:      "requests_total",
+			Help:      "Requests served through the caching transport.",
+		}, []string{"route", "cache", "upstream_status"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "apiproxy",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve requests through the caching transport.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "cache"}),
+		UpstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "apiproxy",
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Time taken by upstream requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "upstream_status"}),
+		RevalidationChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiproxy",
+			Name:      "revalidation_checks_total",
+			Help:      "RevalidationTransport Validator checks of stale cache entries.",
+		}, []string{"route", "result"}),
+		Overrides: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiproxy",
+			Name:      "request_overrides_total",
+			Help:      "RequestModifyingTransport overrides applied.",
+		}, []string{"pattern"}),
+		CircuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "apiproxy",
+			Name:      "circuit_state",
+			Help:      "State of each upstream circuit (0 = closed, 1 = open, 2 = half-open).",
+		}, []string{"circuit"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.Requests, m.RequestDuration, m.UpstreamDuration, m.RevalidationChecks, m.Overrides, m.CircuitState)
+	}
+	return m
+}
+
+// InstrumentCacheStats sets s.OnRequest (calling any existing hook as well) to
+// update m.Requests, m.RequestDuration and m.UpstreamDuration.
+func (m *Metrics) InstrumentCacheStats(s *apiproxy.CacheStats) {
+	prev := s.OnRequest
+	s.OnRequest = func(e apiproxy.CacheEvent) {
+		if prev != nil {
+			prev(e)
+		}
+		upstreamStatus := "none"
+		if e.UpstreamStatusCode != 0 {
+			upstreamStatus = strconv.Itoa(e.UpstreamStatusCode)
+			m.UpstreamDuration.WithLabelValues(e.Pattern, upstreamStatus).Observe(e.UpstreamDuration.Seconds())
+		}
+		m.Requests.WithLabelValues(e.Pattern, string(e.Outcome), upstreamStatus).Inc()
+		m.RequestDuration.WithLabelValues(e.Pattern, string(e.Outcome)).Observe(e.Duration.Seconds())
+	}
+}
+
+// InstrumentRevalidationTransport sets t.OnCheck (calling any existing hook as
+// well) to update m.RevalidationChecks. Requests are labeled with the route
+// pattern determined by s (which may be nil).
+func (m *Metrics) InstrumentRevalidationTransport(t *apiproxy.RevalidationTransport, s *apiproxy.CacheStats) {
+	prev := t.OnCheck
+	t.OnCheck = func(req *http.Request, age time.Duration, valid bool) {
+		if prev != nil {
+			prev(req, age, valid)
+		}
+		var route string
+		if s != nil {
+			route = s.Pattern(req.URL.EscapedPath())
+		}
+		result := "invalid"
+		if valid {
+			result = "valid"
+		}
+		m.RevalidationChecks.WithLabelValues(route, result).Inc()
+	}
+}
+
+// InstrumentRequestModifyingTransport sets t.OnOverride (calling any existing
+// hook as well) to update m.Overrides.
+func (m *Metrics) InstrumentRequestModifyingTransport(t *apiproxy.RequestModifyingTransport) {
+	prev := t.OnOverride
+	t.OnOverride = func(req *http.Request, requestURI *regexp.Regexp) {
+		if prev != nil {
+			prev(req, requestURI)
+		}
+		m.Overrides.WithLabelValues(requestURI.String()).Inc()
+	}
+}
+
+// InstrumentCircuitBreakerTransport sets t.OnStateChange (calling any existing
+// hook as well) to update m.CircuitState.
+func (m *Metrics) InstrumentCircuitBreakerTransport(t *apiproxy.CircuitBreakerTransport) {
+	prev := t.OnStateChange
+	t.OnStateChange = func(circuit string, state apiproxy.CircuitState) {
+		if prev != nil {
+			prev(circuit, state)
+		}
+		m.CircuitState.WithLabelValues(circuit).Set(float64(state))
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sourcegraph/apiproxy"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New(prometheus.NewRegistry())
+
+	stats := &apiproxy.CacheStats{Patterns: []*regexp.Regexp{regexp.MustCompile(`^/foo$`)}}
+	m.InstrumentCacheStats(stats)
+	revalidationTransport := &apiproxy.RevalidationTransport{}
+	m.InstrumentRevalidationTransport(revalidationTransport, stats)
+	reqModifyingTransport := &apiproxy.RequestModifyingTransport{}
+	m.InstrumentRequestModifyingTransport(reqModifyingTransport)
+	breakerTransport := &apiproxy.CircuitBreakerTransport{}
+	m.InstrumentCircuitBreakerTransport(breakerTransport)
+
+	req, err := http.NewRequest("GET", "http://example.com/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats.OnRequest(apiproxy.CacheEvent{Request: req, Pattern: `^/foo$`, Outcome: apiproxy.CacheMiss, UpstreamStatusCode: 200, UpstreamDuration: time.Second})
+	stats.OnRequest(apiproxy.CacheEvent{Request: req, Pattern: `^/foo$`, Outcome: apiproxy.CacheHit})
+	revalidationTransport.OnCheck(req, time.Minute, true)
+	reqModifyingTransport.OnOverride(req, regexp.MustCompile(`^/foo$`))
+	breakerTransport.OnStateChange("example.com", apiproxy.CircuitOpen)
+
+	tests := []struct {
+		collector prometheus.Collector
+		want      float64
+	}{
+		{m.Requests.WithLabelValues(`^/foo$`, "miss", "200"), 1},
+		{m.Requests.WithLabelValues(`^/foo$`, "hit", "none"), 1},
+		{m.RevalidationChecks.WithLabelValues(`^/foo$`, "valid"), 1},
+		{m.Overrides.WithLabelValues(`^/foo$`), 1},
+		{m.CircuitState.WithLabelValues("example.com"), float64(apiproxy.CircuitOpen)},
+	}
+	for i, test := range tests {
+		if got := testutil.ToFloat64(test.collector); test.want != got {
+			t.Errorf("metric %d: want %v, got %v", i, test.want, got)
+		}
+	}
+	if want, got := 2, testutil.CollectAndCount(m.RequestDuration); want != got {
+		t.Errorf("want %d request duration series, got %d", want, got)
+	}
+	if want, got := 1, testutil.CollectAndCount(m.UpstreamDuration); want != got {
+		t.Errorf("want %d upstream duration series, got %d", want, got)
+	}
+}
@@ -0,0 +1,271 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// PrefetchTransport is an implementation of net/http.RoundTripper that
+// prefetches the next pages of paginated list responses (such as those from
+// GitHub's API), so that they are already cached when the client requests
+// them.
+//
+// After a successful GET response with an RFC 5988 Link header, the pages
+// linked by rel="next" are fetched in the background (with the same request
+// headers) through the underlying transport, which should be a caching
+// transport (e.g., httpcache.Transport). Links to other schemes or hosts are
+// not prefetched, so that credentials aren't sent to them.
+type PrefetchTransport struct {
+	// Pages is the maximum number of pages to prefetch after each response. If
+	// zero, no pages are prefetched.
+	Pages int
+
+	// Concurrency is the maximum number of prefetch requests in flight at once.
+	// If zero, 1 is used.
+	Concurrency int
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	mu       sync.Mutex
+	sem      chan struct{}
+	inflight map[string]bool
+	wg       sync.WaitGroup
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *PrefetchTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	resp, err = t.transport().RoundTrip(req)
+	if err != nil || t.Pages <= 0 || req.Method != "GET" || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if next := nextPageURL(req.URL, resp.Header); next != nil && sameOrigin(req.URL, next) {
+		// Copy the headers now, because the caller may reuse req once
+		// RoundTrip returns.
+		t.wg.Add(1)
+		go t.prefetch(req.URL, req.Header.Clone(), next)
+	}
+	return
+}
+
+// Wait blocks until all in-progress prefetches have completed.
+func (t *PrefetchTransport) Wait() {
+	t.wg.Wait()
+}
+
+func (t *PrefetchTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// prefetch fetches up to t.Pages pages, starting at next and following each
+// page's rel="next" link while it has the same origin as the original request
+// URL orig. The original request's header is sent with each request so that
+// the responses are cached under the same variant.
+func (t *PrefetchTransport) prefetch(orig *url.URL, header http.Header, next *url.URL) {
+	defer t.wg.Done()
+
+	t.mu.Lock()
+	if t.sem == nil {
+		concurrency := t.Concurrency
+		if concurrency <= 0 {
+			concurrency = 1
+		}
+		t.sem = make(chan struct{}, concurrency)
+		t.inflight = make(map[string]bool)
+	}
+	t.mu.Unlock()
+
+	for i := 0; i < t.Pages && next != nil && sameOrigin(orig, next); i++ {
+		urlStr := next.String()
+		t.mu.Lock()
+		if t.inflight[urlStr] {
+			// Another prefetch is already following this chain of pages.
+			t.mu.Unlock()
+			return
+		}
+		t.inflight[urlStr] = true
+		t.mu.Unlock()
+
+		t.sem <- struct{}{}
+		next = t.fetch(header, next)
+		<-t.sem
+
+		t.mu.Lock()
+		delete(t.inflight, urlStr)
+		t.mu.Unlock()
+	}
+}
+
+// fetch GETs u (with a copy of header), reading the entire response body so
+// that the underlying transport caches it, and returns the URL of the next
+// page (or nil if there is none).
+func (t *PrefetchTransport) fetch(header http.Header, u *url.URL) *url.URL {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil
+	}
+	req.Header = header.Clone()
+
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	return nextPageURL(u, resp.Header)
+}
+
+// sameOrigin returns true if u and v have the same scheme and host, so that
+// credentials sent to u may be sent to v.
+func sameOrigin(u, v *url.URL) bool {
+	return strings.EqualFold(u.Scheme, v.Scheme) && strings.EqualFold(u.Host, v.Host)
+}
+
+// ForEachPage GETs the paginated list at urlStr using client and calls f with
+// each page's response, following the RFC 5988 Link rel="next" header until
+// there are no more pages. The response body is closed after f returns. If f
+// returns an error or a page's status is not 200 OK, iteration stops and the
+// error is returned.
+//
+// When client uses a PrefetchTransport, later pages will typically be served
+// from the cache.
+func ForEachPage(client *http.Client, urlStr string, header http.Header, f func(resp *http.Response) error) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	for u != nil {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+		err = f(resp)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		u = nextPageURL(u, resp.Header)
+	}
+	return nil
+}
+
+// nextPageURL returns the URL of the rel="next" link in the Link headers,
+// resolved relative to base, or nil if there is none.
+func nextPageURL(base *url.URL, header http.Header) *url.URL {
+	next, present := parseLinkHeader(header)["next"]
+	if !present {
+		return nil
+	}
+	u, err := base.Parse(next)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// parseLinkHeader parses RFC 5988 Link headers (e.g., `<https://api.github.com/
+// user/repos?page=2>; rel="next"`) and returns a map of relation types to
+// target URLs. Target URLs and quoted parameter values may contain commas
+// (e.g., in GitHub search queries).
+func parseLinkHeader(header http.Header) map[string]string {
+	links := make(map[string]string)
+	for _, value := range header["Link"] {
+		s := value
+		for {
+			s = strings.TrimLeft(s, " ,")
+			if !strings.HasPrefix(s, "<") {
+				break
+			}
+			end := strings.Index(s, ">")
+			if end == -1 {
+				break
+			}
+			target := s[1:end]
+			s = s[end+1:]
+
+			var params map[string]string
+			params, s = parseLinkParams(s)
+			// The rel parameter may contain multiple space-separated relation
+			// types.
+			for _, rel := range strings.Fields(params["rel"]) {
+				if _, present := links[strings.ToLower(rel)]; !present {
+					links[strings.ToLower(rel)] = target
+				}
+			}
+		}
+	}
+	return links
+}
+
+// parseLinkParams parses the parameters of a link (e.g., `; rel="next"`) at the
+// start of s, and returns them (keyed by lower-case name) and the rest of s.
+func parseLinkParams(s string) (params map[string]string, rest string) {
+	params = make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if !strings.HasPrefix(s, ";") {
+			return params, s
+		}
+		s = s[1:]
+		end := strings.IndexAny(s, "=;,")
+		if end == -1 {
+			return params, ""
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:end]))
+		if s[end] != '=' {
+			s = s[end:]
+			continue
+		}
+		s = strings.TrimLeft(s[end+1:], " ")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			// Quoted values may contain commas and semicolons.
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end], s[end+1:]
+			}
+			value = strings.Replace(value, `\`, "", -1)
+		} else {
+			end := strings.IndexAny(s, ";,")
+			if end == -1 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		if _, present := params[name]; !present {
+			params[name] = value
+		}
+	}
+}
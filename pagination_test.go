@@ -0,0 +1,167 @@
+package apiproxy
+
+import (
+	"fmt"
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// newPaginatedServer starts a server whose /items list has numPages pages. It
+// returns the server and a function returning the number of requests for each
+// page.
+func newPaginatedServer(numPages int) (*httptest.Server, func() map[int]int) {
+	var mu sync.Mutex
+	pageRequests := make(map[int]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		mu.Lock()
+		pageRequests[page]++
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		if page < numPages {
+			w.Header().Add("Link", fmt.Sprintf(`</items?page=%d>; rel="next", </items?page=%d>; rel="last"`, page+1, numPages))
+		}
+		fmt.Fprintf(w, "page %d", page)
+	}))
+	return server, func() map[int]int {
+		mu.Lock()
+		defer mu.Unlock()
+		counts := make(map[int]int)
+		for page, n := range pageRequests {
+			counts[page] = n
+		}
+		return counts
+	}
+}
+
+func TestPrefetchTransport(t *testing.T) {
+	server, pageRequests := newPaginatedServer(5)
+	defer server.Close()
+
+	transport := &PrefetchTransport{
+		Pages:       2,
+		Concurrency: 2,
+		Transport:   httpcache.NewMemoryCacheTransport(),
+	}
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL + "/items")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	if want, got := "page 1", string(readAll(t, resp.Body)); want != got {
+		t.Errorf("want response body %q, got %q", want, got)
+	}
+	transport.Wait()
+
+	// Pages 2 and 3 should have been prefetched (but not 4 and 5).
+	if want, got := map[int]int{1: 1, 2: 1, 3: 1}, pageRequests(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want page requests %v, got %v", want, got)
+	}
+	for page := 2; page <= 3; page++ {
+		resp, err := client.Get(fmt.Sprintf("%s/items?page=%d", server.URL, page))
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		readAll(t, resp.Body)
+		if resp.Header.Get(httpcache.XFromCache) == "" {
+			t.Errorf("page %d: want response from cache", page)
+		}
+	}
+}
+
+func TestPrefetchTransport_Origin(t *testing.T) {
+	var mu sync.Mutex
+	var otherRequests int
+	var authorizations []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		otherRequests++
+		mu.Unlock()
+	}))
+	defer other.Close()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mu.Unlock()
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/items?page=2>; rel="next"`, server.URL))
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/items?page=3>; rel="next"`, other.URL))
+		}
+	}))
+	defer server.Close()
+
+	transport := &PrefetchTransport{Pages: 3}
+	req := newHTTPGETRequest(t, server.URL+"/items")
+	req.Header.Set("Authorization", "token secret")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	readAll(t, resp.Body)
+	// The caller may reuse the request once RoundTrip returns.
+	req.Header.Set("Authorization", "token changed")
+	transport.Wait()
+
+	// Page 2 is prefetched with the original headers, but the link to the
+	// other host isn't followed.
+	if want := []string{"token secret", "token secret"}; !reflect.DeepEqual(want, authorizations) {
+		t.Errorf("want Authorization headers %q, got %q", want, authorizations)
+	}
+	if otherRequests != 0 {
+		t.Errorf("want no requests to the other host, got %d", otherRequests)
+	}
+}
+
+func TestForEachPage(t *testing.T) {
+	server, pageRequests := newPaginatedServer(3)
+	defer server.Close()
+
+	var bodies []string
+	err := ForEachPage(http.DefaultClient, server.URL+"/items", nil, func(resp *http.Response) error {
+		bodies = append(bodies, string(readAll(t, resp.Body)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("ForEachPage", err)
+	}
+	if want := []string{"page 1", "page 2", "page 3"}; !reflect.DeepEqual(want, bodies) {
+		t.Errorf("want bodies %q, got %q", want, bodies)
+	}
+	if want, got := map[int]int{1: 1, 2: 1, 3: 1}, pageRequests(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want page requests %v, got %v", want, got)
+	}
+}
+
+func TestParseLinkHeader(t *testing.T) {
+	header := http.Header{"Link": []string{
+		`<https://api.github.com/user/repos?page=3&per_page=100>; rel="next", <https://api.github.com/user/repos?page=50&per_page=100>; rel="last"`,
+		`</user/repos?page=1>; rel="first prev"`,
+		`<https://api.github.com/search/code?q=a,b&page=2>; title="a, b; c"; rel=alternate, <https://api.github.com/repos/o/r/compare/a...b,c?page=2>; rel="related"`,
+	}}
+	want := map[string]string{
+		"next":  "https://api.github.com/user/repos?page=3&per_page=100",
+		"last":  "https://api.github.com/user/repos?page=50&per_page=100",
+		"first": "/user/repos?page=1",
+		"prev":  "/user/repos?page=1",
+
+		// Commas in targets and quoted parameter values don't split links.
+		"alternate": "https://api.github.com/search/code?q=a,b&page=2",
+		"related":   "https://api.github.com/repos/o/r/compare/a...b,c?page=2",
+	}
+	if got := parseLinkHeader(header); !reflect.DeepEqual(want, got) {
+		t.Errorf("want links %v, got %v", want, got)
+	}
+}
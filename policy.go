@@ -0,0 +1,205 @@
+package apiproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachePolicyHeader is the response header that CachePolicyTransport sets to
+// the path pattern of the policy it applied. It is stored with cached
+// responses.
+const CachePolicyHeader = "X-Apiproxy-Cache-Policy"
+
+// CachePolicy makes responses to requests whose escaped path matches Pattern
+// cacheable for TTL.
+type CachePolicy struct {
+	Pattern *regexp.Regexp
+	TTL     time.Duration
+}
+
+// NegativeCachePolicy makes error responses to requests whose escaped path
+// matches Pattern cacheable (e.g., so that repeated requests for nonexistent
+// resources don't all reach the upstream server). A zero TTL disables caching
+// of the corresponding responses.
+type NegativeCachePolicy struct {
+	Pattern *regexp.Regexp
+
+	// TTL is the TTL of 404 Not Found and 410 Gone responses.
+	TTL time.Duration
+
+	// RateLimitTTL is the TTL of 429 Too Many Requests responses and of 403
+	// Forbidden responses that indicate a rate limit (with a Retry-After or
+	// X-RateLimit-Remaining: 0 header). A shorter Retry-After takes
+	// precedence.
+	RateLimitTTL time.Duration
+
+	// ServerErrorTTL is the TTL of 5xx responses.
+	ServerErrorTTL time.Duration
+}
+
+// ttl returns the TTL of resp under the policy. If resp isn't cacheable under
+// the policy, ok is false.
+func (p *NegativeCachePolicy) ttl(resp *http.Response) (ttl time.Duration, ok bool) {
+	switch code := resp.StatusCode; {
+	case code == http.StatusNotFound || code == http.StatusGone:
+		ttl = p.TTL
+	case code == http.StatusTooManyRequests || (code == http.StatusForbidden && (resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0")):
+		ttl = p.RateLimitTTL
+		if d, present := retryAfter(resp.Header.Get("Retry-After")); present && d < ttl {
+			ttl = d
+		}
+	case code >= 500:
+		ttl = p.ServerErrorTTL
+	}
+	return ttl, ttl > 0
+}
+
+// CachePolicyTransport is an implementation of net/http.RoundTripper that
+// overrides the caching headers of upstream servers that don't send useful
+// ones (e.g., those that send Cache-Control: no-cache or no ETag).
+//
+// For GET and HEAD requests matching one of Policies, successful responses
+// get a Cache-Control max-age of the policy's TTL (replacing the upstream
+// server's Cache-Control, Expires and Pragma headers), and responses without an
+// ETag get one synthesized from a hash of the body. When a conditional request
+// for a synthesized ETag gets an unchanged body, it is answered with a 304 Not
+// Modified response. Error responses to requests matching one of
+// NegativePolicies are treated in the same way, with the policy's TTL.
+//
+// Responses synthesized by this package's transports rather than received from
+// the upstream server (e.g., RateLimitTransport's 429 responses and
+// CircuitBreakerTransport's responses while a circuit is open) are left
+// unchanged, so they are never cached.
+//
+// Use it as the underlying transport of a caching transport (or of a
+// RevalidationTransport, which can then answer conditional requests for
+// synthesized ETags without contacting the upstream server, and which can use
+// a separate Validator for cached error responses).
+type CachePolicyTransport struct {
+	// Policies are the cache policies. The first policy whose pattern matches
+	// the request's path applies.
+	Policies []CachePolicy
+
+	// NegativePolicies are the cache policies for error responses. The first
+	// policy whose pattern matches the request's path applies.
+	NegativePolicies []NegativeCachePolicy
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *CachePolicyTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil || (req.Method != "GET" && req.Method != "HEAD") || isLocal(resp) {
+		return
+	}
+
+	var ttl time.Duration
+	var pattern *regexp.Regexp
+	if p := t.policy(req); p != nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified) {
+		ttl, pattern = p.TTL, p.Pattern
+	} else if p := t.negativePolicy(req); p != nil {
+		var ok bool
+		if ttl, ok = p.ttl(resp); ok {
+			pattern = p.Pattern
+		}
+	}
+	if pattern == nil {
+		return
+	}
+
+	resp.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl/time.Second)))
+	resp.Header.Del("Expires")
+	resp.Header.Del("Pragma")
+	resp.Header.Set(CachePolicyHeader, pattern.String())
+
+	if resp.StatusCode != http.StatusNotModified && req.Method == "GET" && resp.Header.Get("ETag") == "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		etag := synthesizedETag(body)
+		resp.Header.Set("ETag", etag)
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			resp.StatusCode = http.StatusNotModified
+			resp.Status = "304 Not Modified"
+			resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+			resp.ContentLength = 0
+			resp.Header.Del("Content-Length")
+		}
+	}
+	return resp, nil
+}
+
+// policy returns the policy that applies to req, or nil if none do.
+func (t *CachePolicyTransport) policy(req *http.Request) *CachePolicy {
+	for i, p := range t.Policies {
+		if p.Pattern.MatchString(req.URL.EscapedPath()) {
+			return &t.Policies[i]
+		}
+	}
+	return nil
+}
+
+// negativePolicy returns the negative cache policy that applies to req, or nil
+// if none do.
+func (t *CachePolicyTransport) negativePolicy(req *http.Request) *NegativeCachePolicy {
+	for i, p := range t.NegativePolicies {
+		if p.Pattern.MatchString(req.URL.EscapedPath()) {
+			return &t.NegativePolicies[i]
+		}
+	}
+	return nil
+}
+
+type localResponseKey struct{}
+
+// localRequest returns req marked (in its context) as the request of a
+// response synthesized by one of this package's transports, instead of
+// received from an upstream server. Such responses set their Request field to
+// it, which (unlike their bodies) transports that wrap them preserve.
+func localRequest(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), localResponseKey{}, true))
+}
+
+// isLocal returns true if resp was synthesized by one of this package's
+// transports.
+func isLocal(resp *http.Response) bool {
+	return resp.Request != nil && resp.Request.Context().Value(localResponseKey{}) != nil
+}
+
+// synthesizedETag returns a weak ETag for a response body.
+func synthesizedETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"apiproxy-` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches returns true if the If-None-Match header value ifNoneMatch
+// matches etag (using weak comparison).
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package apiproxy
+
+import (
+	"github.com/sourcegraph/httpcache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePolicyTransport(t *testing.T) {
+	tests := []struct {
+		path           string
+		ttl            time.Duration
+		revalidate     bool
+		body           []string
+		wantRequests   int
+		wantFromCache  bool
+		wantPolicy     bool
+		wantSameETag   bool
+		wantSecondBody string
+	}{
+		// A forced TTL makes the second response fresh.
+		{path: "/api/foo", ttl: time.Hour, body: []string{"a", "b"}, wantRequests: 1, wantFromCache: true, wantPolicy: true, wantSameETag: true, wantSecondBody: "a"},
+		// Stale responses are revalidated with the synthesized ETag, and
+		// unchanged bodies are answered with 304 Not Modified.
+		{path: "/api/foo", body: []string{"a", "a"}, wantRequests: 2, wantFromCache: true, wantPolicy: true, wantSameETag: true, wantSecondBody: "a"},
+		// Changed bodies get a new ETag.
+		{path: "/api/foo", body: []string{"a", "b"}, wantRequests: 2, wantPolicy: true, wantSecondBody: "b"},
+		// A RevalidationTransport can answer revalidations locally.
+		{path: "/api/foo", revalidate: true, body: []string{"a", "b"}, wantRequests: 1, wantFromCache: true, wantPolicy: true, wantSameETag: true, wantSecondBody: "a"},
+		// Other paths are unchanged.
+		{path: "/other", ttl: time.Hour, body: []string{"a", "b"}, wantRequests: 2, wantSecondBody: "b"},
+	}
+	for _, test := range tests {
+		requests := 0
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache, no-store")
+			w.Header().Set("Pragma", "no-cache")
+			w.Write([]byte(test.body[requests]))
+			requests++
+		}))
+
+		var transport http.RoundTripper = &CachePolicyTransport{
+			Policies: []CachePolicy{{Pattern: regexp.MustCompile(`^/api/`), TTL: test.ttl}},
+		}
+		if test.revalidate {
+			transport = &RevalidationTransport{
+				Check:     ValidatorFunc(func(*url.URL, time.Duration) bool { return true }),
+				Transport: transport,
+			}
+		}
+		cachingTransport := httpcache.NewMemoryCacheTransport()
+		cachingTransport.Transport = transport
+		client := &http.Client{Transport: cachingTransport}
+
+		var etags []string
+		var resp *http.Response
+		var body string
+		for i := 0; i < 2; i++ {
+			var err error
+			resp, err = client.Get(target.URL + test.path)
+			if err != nil {
+				t.Fatal("Get", err)
+			}
+			body = string(readAll(t, resp.Body))
+			etags = append(etags, resp.Header.Get("ETag"))
+		}
+		target.Close()
+
+		label := test.path + " " + strings.Join(test.body, ",")
+		if requests != test.wantRequests {
+			t.Errorf("%s: want %d upstream requests, got %d", label, test.wantRequests, requests)
+		}
+		if fromCache := resp.Header.Get(httpcache.XFromCache) != ""; fromCache != test.wantFromCache {
+			t.Errorf("%s: want from cache %v, got %v", label, test.wantFromCache, fromCache)
+		}
+		if policy := resp.Header.Get(CachePolicyHeader); (policy != "") != test.wantPolicy {
+			t.Errorf("%s: want policy applied %v, got %s %q", label, test.wantPolicy, CachePolicyHeader, policy)
+		}
+		if test.wantPolicy && (etags[0] == "" || (etags[0] == etags[1]) != test.wantSameETag) {
+			t.Errorf("%s: want synthesized ETags (same: %v), got %q", label, test.wantSameETag, etags)
+		}
+		if body != test.wantSecondBody {
+			t.Errorf("%s: want second body %q, got %q", label, test.wantSecondBody, body)
+		}
+	}
+}
+
+func TestCachePolicyTransport_Negative(t *testing.T) {
+	tests := []struct {
+		path          string
+		negativeCheck Validator
+		wantStatus    int
+		wantRequests  int
+		wantFromCache bool
+	}{
+		{path: "/repos/missing", wantStatus: http.StatusNotFound, wantRequests: 1, wantFromCache: true},
+		{path: "/repos/limited", wantStatus: http.StatusForbidden, wantRequests: 1, wantFromCache: true},
+		{path: "/repos/forbidden", wantStatus: http.StatusForbidden, wantRequests: 2},
+		{path: "/repos/error", wantStatus: http.StatusInternalServerError, wantRequests: 2},
+		{path: "/other/missing", wantStatus: http.StatusNotFound, wantRequests: 2},
+
+		// Stale negative entries are revalidated with Check...
+		{path: "/stale/missing", wantStatus: http.StatusNotFound, wantRequests: 1, wantFromCache: true},
+		// ... unless a NegativeCheck is set.
+		{
+			path:          "/stale/missing",
+			negativeCheck: ValidatorFunc(func(*url.URL, time.Duration) bool { return false }),
+			wantStatus:    http.StatusNotFound,
+			wantRequests:  2,
+			wantFromCache: true,
+		},
+	}
+	for _, test := range tests {
+		requests := 0
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			switch r.URL.Path {
+			case "/repos/limited":
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.WriteHeader(http.StatusForbidden)
+			case "/repos/forbidden":
+				w.WriteHeader(http.StatusForbidden)
+			case "/repos/error":
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		cache := httpcache.NewMemoryCache()
+		cachingTransport := httpcache.NewTransport(cache)
+		cachingTransport.Transport = &RevalidationTransport{
+			Check:         NeverRevalidate,
+			NegativeCheck: test.negativeCheck,
+			Cache:         cache,
+			Transport: &CachePolicyTransport{
+				NegativePolicies: []NegativeCachePolicy{
+					{Pattern: regexp.MustCompile(`^/repos/`), TTL: time.Hour, RateLimitTTL: time.Hour},
+					// A TTL under a second yields max-age=0, so entries are
+					// always stale.
+					{Pattern: regexp.MustCompile(`^/stale/`), TTL: time.Millisecond},
+				},
+			},
+		}
+		client := &http.Client{Transport: cachingTransport}
+
+		var resp *http.Response
+		for i := 0; i < 2; i++ {
+			var err error
+			resp, err = client.Get(target.URL + test.path)
+			if err != nil {
+				t.Fatal("Get", err)
+			}
+			readAll(t, resp.Body)
+		}
+		target.Close()
+
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("%s: want status %d, got %d", test.path, test.wantStatus, resp.StatusCode)
+		}
+		if requests != test.wantRequests {
+			t.Errorf("%s: want %d upstream requests, got %d", test.path, test.wantRequests, requests)
+		}
+		if fromCache := resp.Header.Get(httpcache.XFromCache) != ""; fromCache != test.wantFromCache {
+			t.Errorf("%s: want from cache %v, got %v", test.path, test.wantFromCache, fromCache)
+		}
+	}
+}
+
+func TestCachePolicyTransport_LocalResponses(t *testing.T) {
+	policies := []NegativeCachePolicy{{Pattern: regexp.MustCompile(``), RateLimitTTL: time.Hour, ServerErrorTTL: time.Hour}}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	breaker := &CircuitBreakerTransport{FailureThreshold: 1, OpenStatusCode: http.StatusServiceUnavailable}
+	limiter := &RateLimitTransport{Host: RateLimit{Rate: 0.001, Burst: 1}, MaxWait: time.Millisecond}
+	tests := []struct {
+		name          string
+		transport     http.RoundTripper
+		wantCacheable bool
+	}{
+		{name: "upstream 503", transport: http.DefaultTransport, wantCacheable: true},
+		// The first request opens the circuit; the second gets the breaker's
+		// own 503.
+		{name: "breaker 503", transport: breaker},
+		{name: "rate limiter 429", transport: &RateLimitTransport{Host: RateLimit{Rate: 0.001, Burst: 1}, MaxWait: time.Millisecond}},
+		// Transports that wrap response bodies don't hide that responses are
+		// local.
+		{name: "wrapped rate limiter 429", transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := limiter.RoundTrip(req)
+			if err == nil {
+				resp.Body = ioutil.NopCloser(resp.Body)
+			}
+			return resp, err
+		})},
+	}
+	for _, test := range tests {
+		transport := &CachePolicyTransport{NegativePolicies: policies, Transport: test.transport}
+		var resp *http.Response
+		for i := 0; i < 2; i++ {
+			var err error
+			resp, err = transport.RoundTrip(newHTTPGETRequest(t, target.URL))
+			if err != nil {
+				t.Fatal("RoundTrip", err)
+			}
+			readAll(t, resp.Body)
+		}
+		if cacheable := resp.Header.Get("Cache-Control") != ""; cacheable != test.wantCacheable {
+			t.Errorf("%s: want cacheable %v, got Cache-Control %q", test.name, test.wantCacheable, resp.Header.Get("Cache-Control"))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package apiproxy
 
 import (
 	"github.com/sourcegraph/httpcache"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -9,15 +10,73 @@ import (
 
 // NewCachingSingleHostReverseProxy constructs a caching reverse proxy handler for
 // target. If cache is nil, a volatile, in-memory cache is used.
+//
+// The proxy's Transport is an *httpcache.Transport whose underlying transport
+// is a *RevalidationTransport (with a nil Check, and with a Cache that reads
+// from cache). Each response has a Cache-Status header (see RFC 9211)
+// describing whether it was a cache hit or was forwarded to target (and why),
+// and responses served from the cache have an Age header.
+//
+// Each variant of a response with a Vary header (e.g., for different Accept
+// request headers) is cached separately, under the URL with a fragment that
+// identifies the variant.
 func NewCachingSingleHostReverseProxy(target *url.URL, cache httpcache.Cache) *httputil.ReverseProxy {
+	return NewPartitionedCachingSingleHostReverseProxy(target, cache, nil)
+}
+
+// NewPartitionedCachingSingleHostReverseProxy is like
+// NewCachingSingleHostReverseProxy, but if identity is non-nil, responses are
+// cached separately for each client identity that it returns (e.g., with
+// ClientIdentity, for each TLS client certificate subject), so that clients
+// are never served responses cached for other clients. Requests for which
+// identity returns the empty string share cache entries.
+func NewPartitionedCachingSingleHostReverseProxy(target *url.URL, cache httpcache.Cache, identity func(req *http.Request) string) *httputil.ReverseProxy {
 	proxy := NewSingleHostReverseProxy(target)
 	if cache == nil {
 		cache = httpcache.NewMemoryCache()
 	}
-	proxy.Transport = httpcache.NewTransport(cache)
+	variants := &varyCache{Cache: cache, identity: identity}
+	cachingTransport := httpcache.NewTransport(variants)
+	cachingTransport.Transport = &RevalidationTransport{Cache: variants}
+	proxy.Transport = cachingTransport
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r2, _ := withUpstreamResult(r)
+		*r = *r2
+		variants.setVariant(r)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The caching transport stores responses (with their headers) once
+		// their bodies have been read, so modify a copy of the headers for
+		// the client and restore the original ones after they're sent.
+		stored := resp.Header
+		resp.Header = stored.Clone()
+		setCacheStatus(resp)
+		resp.Body = &headerRestoringBody{ReadCloser: resp.Body, resp: resp, header: stored}
+		return nil
+	}
 	return proxy
 }
 
+// headerRestoringBody is a response body that sets resp.Header to header when
+// it is first read (after the reverse proxy has copied the response headers
+// to the client).
+type headerRestoringBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	header http.Header
+	done   bool
+}
+
+func (b *headerRestoringBody) Read(p []byte) (int, error) {
+	if !b.done {
+		b.resp.Header, b.done = b.header, true
+	}
+	return b.ReadCloser.Read(p)
+}
+
 // NewSingleHostReverseProxy wraps net/http/httputil.NewSingleHostReverseProxy
 // and sets the Host header based on the target URL.
 func NewSingleHostReverseProxy(url *url.URL) *httputil.ReverseProxy {
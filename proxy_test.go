@@ -2,10 +2,19 @@ package apiproxy
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/sourcegraph/httpcache"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewCachingSingleHostReverseProxy(t *testing.T) {
@@ -51,3 +60,228 @@ func TestNewCachingSingleHostReverseProxy(t *testing.T) {
 		t.Errorf("want response body == %q, got %q", targetResponseBody, resBody)
 	}
 }
+
+func TestNewCachingSingleHostReverseProxy_Vary(t *testing.T) {
+	targetRequestCount := 0
+	targetMux := http.NewServeMux()
+	targetMux.HandleFunc("/repo", func(w http.ResponseWriter, r *http.Request) {
+		targetRequestCount++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept, Authorization")
+		w.Write([]byte(r.Header.Get("Accept") + " " + r.Header.Get("Authorization")))
+	})
+	targetMux.HandleFunc("/stale", func(w http.ResponseWriter, r *http.Request) {
+		targetRequestCount++
+		etag := `"` + r.Header.Get("Accept") + `"`
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(r.Header.Get("Accept")))
+	})
+	target := httptest.NewServer(targetMux)
+	defer target.Close()
+
+	handler := NewCachingSingleHostReverseProxy(mustParseURL(t, target.URL), nil)
+	handler.Transport.(*httpcache.Transport).Transport.(*RevalidationTransport).Check = PathMatchValidator{
+		regexp.MustCompile(`^/stale$`): time.Hour,
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	const (
+		json = "application/vnd.github.v3+json"
+		raw  = "application/vnd.github.v3.raw"
+	)
+	tests := []struct {
+		path, accept, authorization string
+		wantBody                    string
+		wantFromCache               bool
+	}{
+		{path: "/repo", accept: json, wantBody: json + " "},
+		{path: "/repo", accept: raw, wantBody: raw + " "},
+		{path: "/repo", accept: json, wantBody: json + " ", wantFromCache: true},
+		{path: "/repo", accept: raw, wantBody: raw + " ", wantFromCache: true},
+		{path: "/repo", accept: json, authorization: "token a", wantBody: json + " token a"},
+		{path: "/repo", accept: json, authorization: "token b", wantBody: json + " token b"},
+		{path: "/repo", accept: json, authorization: "token a", wantBody: json + " token a", wantFromCache: true},
+		{path: "/repo", accept: json, wantBody: json + " ", wantFromCache: true},
+
+		// Revalidations (answered by the RevalidationTransport) use the
+		// request's variant.
+		{path: "/stale", accept: json, wantBody: json},
+		{path: "/stale", accept: raw, wantBody: raw},
+		{path: "/stale", accept: json, wantBody: json, wantFromCache: true},
+		{path: "/stale", accept: raw, wantBody: raw, wantFromCache: true},
+	}
+	wantTargetRequestCount := 0
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", proxy.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Do", err)
+		}
+		label := test.path + " " + test.accept + " " + test.authorization
+		if body := string(readAll(t, res.Body)); body != test.wantBody {
+			t.Errorf("%s: want body %q, got %q", label, test.wantBody, body)
+		}
+		if !test.wantFromCache {
+			wantTargetRequestCount++
+		}
+		if targetRequestCount != wantTargetRequestCount {
+			t.Errorf("%s: want %d target requests, got %d", label, wantTargetRequestCount, targetRequestCount)
+			targetRequestCount = wantTargetRequestCount
+		}
+		for name := range res.Header {
+			if strings.HasPrefix(name, "X-Varied-") {
+				t.Errorf("%s: want X-Varied-* headers removed, got %s", label, name)
+			}
+		}
+	}
+}
+
+func TestNewCachingSingleHostReverseProxy_CacheStatus(t *testing.T) {
+	targetMux := http.NewServeMux()
+	targetMux.HandleFunc("/fresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Write([]byte("fresh"))
+	})
+	targetMux.HandleFunc("/stale", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"foo"`)
+		if r.Header.Get("If-None-Match") == `"foo"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("stale"))
+	})
+	target := httptest.NewServer(targetMux)
+	defer target.Close()
+	targetURL := mustParseURL(t, target.URL)
+
+	cache := httpcache.NewMemoryCache()
+	handler := NewCachingSingleHostReverseProxy(targetURL, cache)
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+	proxyURL := mustParseURL(t, proxy.URL)
+
+	tests := []struct {
+		path            string
+		check           Validator
+		wantCacheStatus string
+		wantAge         bool
+	}{
+		{"/fresh", nil, `^apiproxy; fwd=miss; fwd-status=200$`, false},
+		{"/fresh", nil, `^apiproxy; hit; ttl=(59|60)$`, true},
+		{"/stale", nil, `^apiproxy; fwd=miss; fwd-status=200$`, false},
+		{"/stale", nil, `^apiproxy; fwd=stale; fwd-status=304$`, true},
+		{"/stale", PathMatchValidator{regexp.MustCompile(`^/stale$`): time.Hour}, `^apiproxy; hit; ttl=(-1|0); detail="\^/stale\$"$`, true},
+	}
+	for _, test := range tests {
+		handler.Transport.(*httpcache.Transport).Transport = &RevalidationTransport{Check: test.check, Cache: cache}
+		res := httpGet(t, proxyURL.ResolveReference(&url.URL{Path: test.path}))
+		readAll(t, res.Body)
+		if got := res.Header["Cache-Status"]; len(got) != 1 || !regexp.MustCompile(test.wantCacheStatus).MatchString(got[0]) {
+			t.Errorf("%s: want Cache-Status matching %q, got %q", test.path, test.wantCacheStatus, got)
+		}
+		if got := res.Header.Get("Age") != ""; test.wantAge != got {
+			t.Errorf("%s: want Age header present == %v, got %v", test.path, test.wantAge, got)
+		}
+		if got := res.Header.Get(responseTimeHeader); got != "" {
+			t.Errorf("%s: want %s removed, got %q", test.path, responseTimeHeader, got)
+		}
+	}
+}
+
+func TestNewCachingSingleHostReverseProxy_StoredHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("qux"))
+	}))
+	defer target.Close()
+
+	cache := &recordingCache{Cache: httpcache.NewMemoryCache()}
+	proxy := httptest.NewServer(NewCachingSingleHostReverseProxy(mustParseURL(t, target.URL), cache))
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		res := httpGet(t, mustParseURL(t, proxy.URL+"/foo"))
+		readAll(t, res.Body)
+		if res.Header.Get("Cache-Status") == "" {
+			t.Errorf("request %d: want Cache-Status header", i)
+		}
+	}
+	// The headers added for the client aren't stored with the response.
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.stored) == 0 {
+		t.Fatal("want response to be stored")
+	}
+	for _, data := range cache.stored {
+		if s := string(data); strings.Contains(s, "\r\nCache-Status:") || strings.Contains(s, "\r\nAge:") {
+			t.Errorf("want stored response without Cache-Status or Age headers, got %q", s)
+		}
+	}
+}
+
+// recordingCache is an httpcache.Cache that records the responses stored in
+// it.
+type recordingCache struct {
+	httpcache.Cache
+	stored [][]byte
+	mu     sync.Mutex
+}
+
+func (c *recordingCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	c.stored = append(c.stored, data)
+	c.mu.Unlock()
+	c.Cache.Set(key, data)
+}
+
+func TestNewPartitionedCachingSingleHostReverseProxy(t *testing.T) {
+	targetRequestCount := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetRequestCount++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "response %d", targetRequestCount)
+	}))
+	defer target.Close()
+
+	handler := NewPartitionedCachingSingleHostReverseProxy(mustParseURL(t, target.URL), nil, ClientIdentity)
+	get := func(subject string) string {
+		req := httptest.NewRequest("GET", "https://proxy.example.com/private", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: subject}}}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// Clients with different certificate subjects don't share cache entries.
+	tests := []struct{ subject, want string }{
+		{"alice", "response 1"},
+		{"bob", "response 2"},
+		{"alice", "response 1"},
+		{"bob", "response 2"},
+	}
+	for _, test := range tests {
+		if got := get(test.subject); test.want != got {
+			t.Errorf("%s: want body %q, got %q", test.subject, test.want, got)
+		}
+	}
+	if want := 2; targetRequestCount != want {
+		t.Errorf("want %d target requests, got %d", want, targetRequestCount)
+	}
+}
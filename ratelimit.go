@@ -0,0 +1,236 @@
+package apiproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token-bucket rate limit: requests consume a token each, and
+// tokens are added at Rate per second up to a maximum of Burst.
+type RateLimit struct {
+	// Rate is the number of tokens added per second. If zero, requests are
+	// not limited.
+	Rate float64
+
+	// Burst is the maximum number of tokens (i.e., the number of requests
+	// that may be sent at once after an idle period). If less than 1, 1 is
+	// used.
+	Burst int
+}
+
+// RouteRateLimit is the rate limit for requests whose escaped path matches
+// Pattern.
+type RouteRateLimit struct {
+	Pattern *regexp.Regexp
+	Limit   RateLimit
+}
+
+// RateLimitTransport is an implementation of net/http.RoundTripper that limits
+// the rate of requests to upstream servers, to protect them (and upstream rate
+// limits) from bursts of requests.
+//
+// Each request consumes a token from its host's bucket (limited by Host), the
+// bucket for its host and the first of Routes that matches its path, and (if
+// Client is set) the bucket for its host and client identity. If the buckets
+// don't have tokens, the request waits for them for up to MaxWait; if it would
+// have to wait longer, RoundTrip returns a 429 Too Many Requests response with
+// a Retry-After header instead.
+//
+// To avoid consuming tokens for requests served from the cache, use it as the
+// underlying transport of a caching transport. To also limit retries, use it
+// as the underlying transport of a RetryTransport.
+type RateLimitTransport struct {
+	// Host limits requests to each upstream host.
+	Host RateLimit
+
+	// Routes limit requests to each upstream host whose paths match a
+	// pattern. Only the first matching route's limit applies.
+	Routes []RouteRateLimit
+
+	// Client limits requests to each upstream host by each client identity.
+	Client RateLimit
+
+	// Identity returns a string identifying the client that made the request,
+	// for Client limits. If nil, the request's Authorization header is used.
+	Identity func(req *http.Request) string
+
+	// MaxWait is the maximum time a request waits for tokens. If zero, excess
+	// requests are rejected immediately.
+	MaxWait time.Duration
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	mu      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// bucketSweepInterval is how often RateLimitTransport deletes full buckets
+// (which are equivalent to missing ones), so that buckets for clients and hosts
+// that are no longer active don't accumulate.
+const bucketSweepInterval = time.Minute
+
+// burst returns the maximum number of tokens in a bucket with limit l.
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// refill adds the tokens accumulated since b.last to b.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if burst := b.limit.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	buckets, wait, ok := t.reserve(req, time.Now())
+	if !ok {
+		return tooManyRequests(req, wait), nil
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			// The request isn't sent, so return its tokens.
+			t.refund(buckets)
+			return nil, req.Context().Err()
+		}
+	}
+	return transport.RoundTrip(req)
+}
+
+// reserve takes a token from each of req's buckets and returns them and how
+// long req must wait before being sent. If it would have to wait longer than
+// MaxWait, no tokens are taken and ok is false.
+func (t *RateLimitTransport) reserve(req *http.Request, now time.Time) (buckets []*tokenBucket, wait time.Duration, ok bool) {
+	type limitedBucket struct {
+		key   string
+		limit RateLimit
+	}
+	host := req.URL.Host
+	limits := []limitedBucket{{"host " + host, t.Host}}
+	for _, r := range t.Routes {
+		if r.Pattern.MatchString(req.URL.EscapedPath()) {
+			limits = append(limits, limitedBucket{"route " + host + " " + r.Pattern.String(), r.Limit})
+			break
+		}
+	}
+	if t.Client.Rate > 0 {
+		var identity string
+		if t.Identity != nil {
+			identity = t.Identity(req)
+		} else {
+			identity = req.Header.Get("Authorization")
+		}
+		// Hash the identity so that credentials aren't kept in memory.
+		sum := sha256.Sum256([]byte(identity))
+		limits = append(limits, limitedBucket{"client " + host + " " + hex.EncodeToString(sum[:]), t.Client})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(t.swept) >= bucketSweepInterval {
+		t.sweep(now)
+	}
+	for _, l := range limits {
+		if l.limit.Rate <= 0 {
+			continue
+		}
+		b := t.buckets[l.key]
+		if b == nil {
+			b = &tokenBucket{tokens: l.limit.burst(), last: now, limit: l.limit}
+			t.buckets[l.key] = b
+		}
+		b.limit = l.limit
+		b.refill(now)
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > t.MaxWait {
+		return nil, wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return buckets, wait, true
+}
+
+// refund returns the tokens taken by reserve from buckets.
+func (t *RateLimitTransport) refund(buckets []*tokenBucket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range buckets {
+		b.tokens++
+		if burst := b.limit.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+}
+
+// sweep deletes the buckets that have refilled by now. The caller must hold
+// t.mu.
+func (t *RateLimitTransport) sweep(now time.Time) {
+	for key, b := range t.buckets {
+		b.refill(now)
+		if b.tokens >= b.limit.burst() {
+			delete(t.buckets, key)
+		}
+	}
+	t.swept = now
+}
+
+// tooManyRequests returns a 429 Too Many Requests response to req that says to
+// retry after wait.
+func tooManyRequests(req *http.Request, wait time.Duration) *http.Response {
+	body := fmt.Sprintf("apiproxy: rate limit exceeded for %s\n", req.URL.Host)
+	return &http.Response{
+		Status:     "429 Too Many Requests",
+		StatusCode: http.StatusTooManyRequests,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+			"Retry-After":  []string{strconv.Itoa(int((wait + time.Second - 1) / time.Second))},
+		},
+		ContentLength: int64(len(body)),
+		Request:       localRequest(req),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
@@ -0,0 +1,137 @@
+package apiproxy
+
+import (
+	"context"
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransport_reserve(t *testing.T) {
+	transport := &RateLimitTransport{
+		Host:    RateLimit{Rate: 10, Burst: 2},
+		Routes:  []RouteRateLimit{{regexp.MustCompile(`^/search`), RateLimit{Rate: 1}}},
+		MaxWait: 200 * time.Millisecond,
+	}
+	now := time.Now()
+	tests := []struct {
+		path     string
+		auth     string
+		at       time.Duration
+		wantWait time.Duration
+		wantOK   bool
+	}{
+		// The host bucket allows a burst of 2, then 10 requests per second.
+		{"/a", "", 0, 0, true},
+		{"/a", "", 0, 0, true},
+		{"/a", "", 0, 100 * time.Millisecond, true},
+		{"/a", "", 0, 200 * time.Millisecond, true},
+		{"/a", "", 0, 300 * time.Millisecond, false},
+
+		// The route bucket allows 1 request per second.
+		{"/search", "", time.Second, 0, true},
+		{"/search", "", time.Second, time.Second, false},
+
+		// Each client has its own bucket, which allows a burst of 1.
+		{"/b", "token a", 2 * time.Second, 0, true},
+		{"/b", "token a", 2 * time.Second, 10 * time.Millisecond, true},
+		{"/b", "token b", 2 * time.Second, 0, true},
+	}
+	clientTransport := &RateLimitTransport{Client: RateLimit{Rate: 100}, MaxWait: time.Second}
+	for i, test := range tests {
+		req := newHTTPGETRequest(t, "http://example.com"+test.path)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rt := transport
+		if test.auth != "" {
+			rt = clientTransport
+		}
+		_, wait, ok := rt.reserve(req, now.Add(test.at))
+		if test.wantOK != ok {
+			t.Errorf("%d: %s: want ok == %v, got %v", i, test.path, test.wantOK, ok)
+		}
+		if d := wait - test.wantWait; d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("%d: %s: want wait %s, got %s", i, test.path, test.wantWait, wait)
+		}
+	}
+}
+
+func TestRateLimitTransport_cacheHits(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer target.Close()
+
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = &RateLimitTransport{Host: RateLimit{Rate: 0.001}}
+	client := &http.Client{Transport: cachingTransport}
+
+	tests := []struct {
+		path           string
+		wantStatusCode int
+	}{
+		{"/a", http.StatusOK},
+		// Cache hits don't consume tokens.
+		{"/a", http.StatusOK},
+		{"/b", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		resp, err := client.Get(target.URL + test.path)
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		readAll(t, resp.Body)
+		if test.wantStatusCode != resp.StatusCode {
+			t.Errorf("%s: want status code %d, got %d", test.path, test.wantStatusCode, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s: want Retry-After header", test.path)
+		}
+	}
+}
+
+func TestRateLimitTransport_canceled(t *testing.T) {
+	transport := &RateLimitTransport{
+		Host:    RateLimit{Rate: 10},
+		MaxWait: time.Second,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	now := time.Now()
+	transport.reserve(newHTTPGETRequest(t, "http://example.com/"), now)
+
+	// A request that is canceled while waiting returns its token.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com/").WithContext(ctx)); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+	if _, wait, _ := transport.reserve(newHTTPGETRequest(t, "http://example.com/"), now); wait > 110*time.Millisecond {
+		t.Errorf("want wait of about 100ms after canceled request, got %s", wait)
+	}
+}
+
+func TestRateLimitTransport_sweep(t *testing.T) {
+	transport := &RateLimitTransport{Client: RateLimit{Rate: 1}}
+	now := time.Now()
+	for _, auth := range []string{"token a", "token b", "token c"} {
+		req := newHTTPGETRequest(t, "http://example.com/")
+		req.Header.Set("Authorization", auth)
+		transport.reserve(req, now)
+	}
+	if want, got := 3, len(transport.buckets); want != got {
+		t.Fatalf("want %d buckets, got %d", want, got)
+	}
+
+	// Buckets that have refilled are deleted.
+	transport.reserve(newHTTPGETRequest(t, "http://example.com/"), now.Add(bucketSweepInterval))
+	if want, got := 1, len(transport.buckets); want != got {
+		t.Errorf("want %d bucket after sweep, got %d", want, got)
+	}
+}
@@ -0,0 +1,174 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResponseModifyingTransport is an implementation of net/http.RoundTripper that
+// allows responses to requests matching certain predicates to be modified
+// (e.g., to overwrite or strip headers, or to rewrite JSON bodies).
+//
+// Use it as the underlying transport of a caching transport to fix an upstream
+// server's caching headers (e.g., to force a Cache-Control max-age, strip
+// Set-Cookie, or add Vary) before the caching transport sees them.
+type ResponseModifyingTransport struct {
+	rules   []responseRule
+	rulesMu sync.Mutex
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+}
+
+// ResponseRule describes how ResponseModifyingTransport modifies responses
+// that match it.
+type ResponseRule struct {
+	// Methods are the request methods that the rule applies to. If empty, it
+	// applies to GET and HEAD requests.
+	Methods []string
+
+	// Host, if non-nil, must match the request's host for the rule to apply.
+	Host *regexp.Regexp
+
+	// StatusCodes are the response status codes that the rule applies to. If
+	// empty, it applies to all responses.
+	StatusCodes []int
+
+	// DeleteHeaders are the names of headers to delete.
+	DeleteHeaders []string
+
+	// SetHeaders are set on the response, overwriting existing headers of the
+	// same name.
+	SetHeaders http.Header
+
+	// AddHeaders are added to the response's headers, after any existing
+	// values.
+	AddHeaders http.Header
+
+	// ModifyJSON, if non-nil, is called with the decoded body of JSON
+	// responses (numbers are decoded as json.Number), and its result is
+	// encoded as the new body. If it returns an error, RoundTrip returns the
+	// error. Bodies that aren't valid JSON or that have a Content-Encoding
+	// are left unchanged.
+	ModifyJSON func(resp *http.Response, v interface{}) (interface{}, error)
+}
+
+type responseRule struct {
+	requestURI *regexp.Regexp
+	ResponseRule
+}
+
+// AddRule instructs the transport to modify responses to requests whose request
+// URI matches the regexp (and that match the rule's Methods, Host and
+// StatusCodes) as described by rule. Rules are applied in the order they were
+// added.
+func (t *ResponseModifyingTransport) AddRule(requestURI *regexp.Regexp, rule ResponseRule) {
+	t.rulesMu.Lock()
+	defer t.rulesMu.Unlock()
+	t.rules = append(t.rules, responseRule{requestURI, rule})
+}
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *ResponseModifyingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+
+	requestURI := req.URL.RequestURI()
+	method := strings.ToUpper(req.Method)
+	t.rulesMu.Lock()
+	rules := t.rules
+	t.rulesMu.Unlock()
+
+	for _, rule := range rules {
+		if !rule.requestURI.MatchString(requestURI) || !rule.matches(method, req.URL.Host, resp.StatusCode) {
+			continue
+		}
+		if err := rule.apply(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// matches returns true if the rule applies to responses with the given status
+// code to requests with the given method (in upper case) and host.
+func (r *ResponseRule) matches(method, host string, statusCode int) bool {
+	if len(r.StatusCodes) > 0 {
+		found := false
+		for _, c := range r.StatusCodes {
+			if c == statusCode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return (&RequestRule{Methods: r.Methods, Host: r.Host}).matches(method, host)
+}
+
+// apply modifies resp as described by the rule.
+func (r *ResponseRule) apply(resp *http.Response) error {
+	for _, name := range r.DeleteHeaders {
+		resp.Header.Del(name)
+	}
+	for name, val := range r.SetHeaders {
+		resp.Header[textproto.CanonicalMIMEHeaderKey(name)] = append([]string(nil), val...)
+	}
+	for name, vals := range r.AddHeaders {
+		for _, v := range vals {
+			resp.Header.Add(name, v)
+		}
+	}
+
+	if r.ModifyJSON != nil && isJSON(resp.Header.Get("Content-Type")) && resp.Header.Get("Content-Encoding") == "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil
+		}
+		if v, err = r.ModifyJSON(resp, v); err != nil {
+			return err
+		}
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// isJSON returns true if contentType is a JSON media type (such as
+// application/json or application/vnd.github+json).
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
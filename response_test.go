@@ -0,0 +1,96 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestResponseModifyingTransport(t *testing.T) {
+	requestCount := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("Cache-Control", "no-cache, private")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{"id": 12345678901234567890, "token": "secret"}`))
+	}))
+	defer target.Close()
+
+	transport := &ResponseModifyingTransport{}
+	transport.AddRule(regexp.MustCompile(`^/`), ResponseRule{
+		StatusCodes:   []int{http.StatusOK},
+		DeleteHeaders: []string{"Set-Cookie"},
+		SetHeaders:    http.Header{"Cache-Control": []string{"max-age=60"}},
+		AddHeaders:    http.Header{"Vary": []string{"Accept"}},
+		ModifyJSON: func(resp *http.Response, v interface{}) (interface{}, error) {
+			delete(v.(map[string]interface{}), "token")
+			return v, nil
+		},
+	})
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = transport
+	client := &http.Client{Transport: cachingTransport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(target.URL + "/foo")
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		body := readAll(t, resp.Body)
+		if want := `{"id":12345678901234567890}`; string(body) != want {
+			t.Errorf("want body %s, got %s", want, body)
+		}
+		if got := resp.Header.Get("Set-Cookie"); got != "" {
+			t.Errorf("want Set-Cookie deleted, got %q", got)
+		}
+		if want, got := "Accept", resp.Header.Get("Vary"); want != got {
+			t.Errorf("want Vary %q, got %q", want, got)
+		}
+	}
+	// The forced max-age makes the second response come from the cache.
+	if want := 1; requestCount != want {
+		t.Errorf("want %d upstream requests, got %d", want, requestCount)
+	}
+
+	// Rules don't apply to other status codes.
+	resp, err := client.Get(target.URL + "/missing")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(readAll(t, resp.Body), &v); err != nil {
+		t.Fatal(err)
+	}
+	if _, present := v["token"]; !present || resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("want 404 response unmodified, got headers %v and body %v", resp.Header, v)
+	}
+}
+
+func TestResponseRule_SetHeadersNotAliased(t *testing.T) {
+	rule := &ResponseRule{
+		SetHeaders: http.Header{"Cache-Control": make([]string, 1, 2)},
+		AddHeaders: http.Header{"Cache-Control": []string{"public"}},
+	}
+	rule.SetHeaders["Cache-Control"][0] = "max-age=60"
+	resp := &http.Response{Header: http.Header{}}
+	if err := rule.apply(resp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Header["Cache-Control"][0] = "no-store"
+
+	// Neither the Add nor the later edit may write through to the rule.
+	if want, got := []string{"max-age=60"}, rule.SetHeaders["Cache-Control"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("want rule SetHeaders %q, got %q", want, got)
+	}
+	if got := rule.SetHeaders["Cache-Control"][:2][1]; got != "" {
+		t.Errorf("want rule SetHeaders backing array untouched, got %q", got)
+	}
+}
@@ -0,0 +1,194 @@
+package apiproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryTransport is an implementation of net/http.RoundTripper that retries
+// idempotent requests that fail with a connection error or a 429, 502, 503 or
+// 504 response, waiting a jittered, exponentially increasing time between
+// attempts (or the time given by the response's Retry-After header).
+//
+// Responses whose Retry-After wait exceeds MaxBackoff are returned without
+// retrying.
+//
+// It can be used as the underlying transport of a RevalidationTransport, so
+// that transient upstream errors don't reach the client.
+type RetryTransport struct {
+	// MaxRetries is the maximum number of times a request is retried. If zero,
+	// DefaultMaxRetries is used; if negative (e.g., -1), requests aren't
+	// retried.
+	MaxRetries int
+
+	// MinBackoff and MaxBackoff bound the wait before each retry, which
+	// doubles (with jitter) from MinBackoff up to MaxBackoff. If zero,
+	// DefaultMinBackoff and DefaultMaxBackoff are used.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxElapsed, if nonzero, is the deadline (measured from the first
+	// attempt) after which a request is no longer retried. A retry whose wait
+	// would end after the deadline is not attempted.
+	MaxElapsed time.Duration
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	// OnRetry, if non-nil, is called before waiting to retry a request, with
+	// the failed attempt's response or error, the number of the retry (1 for
+	// the first retry), and the wait.
+	OnRetry func(req *http.Request, resp *http.Response, err error, retry int, wait time.Duration)
+}
+
+// Defaults for RetryTransport's fields.
+const (
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *RetryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if !isIdempotent(req) {
+		return transport.RoundTrip(req)
+	}
+
+	maxRetries := t.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+	var deadline time.Time
+	if t.MaxElapsed != 0 {
+		deadline = time.Now().Add(t.MaxElapsed)
+	}
+
+	for retry := 0; ; retry++ {
+		if retry > 0 && req.Body != nil && req.Body != http.NoBody {
+			req2 := *req
+			if req2.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+			resp, err = transport.RoundTrip(&req2)
+		} else {
+			resp, err = transport.RoundTrip(req)
+		}
+		if retry == maxRetries || !shouldRetry(req, resp, err) {
+			return
+		}
+
+		wait := t.backoff(retry)
+		if resp != nil {
+			if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				if d > t.maxBackoff() {
+					return
+				}
+				wait = d
+			}
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return
+		}
+		if t.OnRetry != nil {
+			t.OnRetry(req, resp, err, retry+1, wait)
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff returns the wait before retry number retry+1: a random duration
+// between half and all of MinBackoff*2^retry (capped at MaxBackoff).
+func (t *RetryTransport) backoff(retry int) time.Duration {
+	min, max := t.MinBackoff, t.maxBackoff()
+	if min == 0 {
+		min = DefaultMinBackoff
+	}
+	d := min
+	for i := 0; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maxBackoff returns t.MaxBackoff or its default.
+func (t *RetryTransport) maxBackoff() time.Duration {
+	if t.MaxBackoff == 0 {
+		return DefaultMaxBackoff
+	}
+	return t.MaxBackoff
+}
+
+// isIdempotent returns true if req can safely be retried: its method is
+// idempotent (or it has an Idempotency-Key header), and its body (if any) can
+// be re-read.
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// shouldRetry returns true if a request that yielded resp and err should be
+// retried.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Don't retry requests that were canceled or timed out.
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number
+// of seconds or an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		d := date.Sub(time.Now())
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
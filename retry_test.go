@@ -0,0 +1,125 @@
+package apiproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		method           string
+		statusCodes      []int
+		retryAfter       string
+		maxElapsed       time.Duration
+		wantStatusCode   int
+		wantRequestCount int
+	}{
+		{"GET", []int{http.StatusOK}, "", 0, http.StatusOK, 1},
+		{"GET", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, "", 0, http.StatusOK, 3},
+		{"GET", []int{http.StatusTooManyRequests, http.StatusOK}, "0", 0, http.StatusOK, 2},
+		{"GET", []int{http.StatusGatewayTimeout, http.StatusGatewayTimeout, http.StatusGatewayTimeout}, "", 0, http.StatusGatewayTimeout, 3},
+		{"GET", []int{http.StatusNotFound, http.StatusOK}, "", 0, http.StatusNotFound, 1},
+		{"POST", []int{http.StatusBadGateway, http.StatusOK}, "", 0, http.StatusBadGateway, 1},
+
+		// Retry-After waits longer than MaxBackoff aren't honored.
+		{"GET", []int{http.StatusTooManyRequests, http.StatusOK}, "3600", 0, http.StatusTooManyRequests, 1},
+
+		// Retries that would wait past the deadline aren't attempted.
+		{"GET", []int{http.StatusServiceUnavailable, http.StatusOK}, "1", time.Millisecond, http.StatusServiceUnavailable, 1},
+	}
+	for _, test := range tests {
+		requestCount := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			statusCode := test.statusCodes[requestCount]
+			requestCount++
+			if test.retryAfter != "" {
+				w.Header().Set("Retry-After", test.retryAfter)
+			}
+			w.WriteHeader(statusCode)
+		}))
+
+		transport := &RetryTransport{
+			MaxRetries: 2,
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 2 * time.Second,
+			MaxElapsed: test.maxElapsed,
+		}
+		req, err := http.NewRequest(test.method, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		readAll(t, resp.Body)
+		server.Close()
+
+		label := fmt.Sprintf("%s %v", test.method, test.statusCodes)
+		if test.wantStatusCode != resp.StatusCode {
+			t.Errorf("%s: want status code %d, got %d", label, test.wantStatusCode, resp.StatusCode)
+		}
+		if test.wantRequestCount != requestCount {
+			t.Errorf("%s: want %d requests, got %d", label, test.wantRequestCount, requestCount)
+		}
+	}
+}
+
+func TestRetryTransport_connectionError(t *testing.T) {
+	attempts := 0
+	transport := &RetryTransport{
+		MinBackoff: time.Millisecond,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			if attempts == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	var retries []int
+	transport.OnRetry = func(req *http.Request, resp *http.Response, err error, retry int, wait time.Duration) {
+		retries = append(retries, retry)
+	}
+	resp, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com"))
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if want := http.StatusOK; resp.StatusCode != want {
+		t.Errorf("want status code %d, got %d", want, resp.StatusCode)
+	}
+	if want := 2; attempts != want {
+		t.Errorf("want %d attempts, got %d", want, attempts)
+	}
+	if len(retries) != 1 || retries[0] != 1 {
+		t.Errorf("want OnRetry called once for retry 1, got %v", retries)
+	}
+}
+
+func TestRetryTransport_disabled(t *testing.T) {
+	attempts := 0
+	transport := &RetryTransport{
+		MaxRetries: -1,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, errors.New("connection reset")
+		}),
+	}
+	if _, err := transport.RoundTrip(newHTTPGETRequest(t, "http://example.com")); err == nil {
+		t.Error("want RoundTrip error, got nil")
+	}
+	if want := 1; attempts != want {
+		t.Errorf("want %d attempts, got %d", want, attempts)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -4,9 +4,19 @@ import (
 	_ "github.com/google/go-github/github"
 	"github.com/sourcegraph/apiproxy"
 	"regexp"
+	"strings"
 	"time"
 )
 
+// EnterpriseAPIPath is the path prefix under which GitHub Enterprise instances
+// serve their API (e.g., https://github.example.com/api/v3/repos/foo/bar).
+const EnterpriseAPIPath = "/api/v3"
+
+// EnterpriseUploadsPath is the path prefix under which GitHub Enterprise
+// instances serve the uploads API (e.g.,
+// https://github.example.com/api/uploads/repos/foo/bar/releases/1/assets).
+const EnterpriseUploadsPath = "/api/uploads"
+
 // MaxAge represents custom cache max-ages for GitHub API resources. It
 // implements the apiproxy.Validator interface and is intended for use with
 // RevalidationTransport. TODO(sqs): add fields for all GitHub API resources.
@@ -15,26 +25,57 @@ type MaxAge struct {
 	Repository   time.Duration
 	Repositories time.Duration
 	Activity     time.Duration
+
+	// BasePath is the path prefix of the GitHub API. It is empty for
+	// api.github.com and EnterpriseAPIPath for GitHub Enterprise.
+	BasePath string
+
+	// UploadsPath, if set, is the path prefix of the GitHub uploads API,
+	// whose paths are matched in the same way as those under BasePath. It is
+	// EnterpriseUploadsPath for GitHub Enterprise (uploads.github.com serves
+	// the uploads API at its root, which BasePath covers).
+	UploadsPath string
 }
 
-// Regexps for GitHub API resource paths. TODO(sqs): add regexps for all GitHub
-// API resources.
-var (
-	publicRepos      = regexp.MustCompile(`^/repositories$`)
-	repoPath         = regexp.MustCompile(`^/repos/[^/]+/[^/]+`)
-	userPath         = regexp.MustCompile(`^/user(s/[^/]+)?$`)
-	userPublicEvents = regexp.MustCompile(`^/users/[^/]+/events/public$`)
-	userReposPath    = regexp.MustCompile(`^/user(s/[^/]+)?/repos$`)
+// Patterns for GitHub API resource paths, relative to the API base path.
+// TODO(sqs): add patterns for all GitHub API resources.
+const (
+	publicRepos      = `/repositories$`
+	repoPath         = `/repos/[^/]+/[^/]+`
+	userPath         = `/user(s/[^/]+)?$`
+	userPublicEvents = `/users/[^/]+/events/public$`
+	userReposPath    = `/user(s/[^/]+)?/repos$`
 )
 
 // Validator returns an apiproxy.Validator that implements the MaxAge cache
 // aging logic.
 func (a *MaxAge) Validator() apiproxy.Validator {
 	return &apiproxy.PathMatchValidator{
-		publicRepos:      a.Repositories,
-		repoPath:         a.Repository,
-		userPath:         a.User,
-		userPublicEvents: a.Activity,
-		userReposPath:    a.Repositories,
+		a.pathRegexp(publicRepos):      a.Repositories,
+		a.pathRegexp(repoPath):         a.Repository,
+		a.pathRegexp(userPath):         a.User,
+		a.pathRegexp(userPublicEvents): a.Activity,
+		a.pathRegexp(userReposPath):    a.Repositories,
+	}
+}
+
+// Patterns returns the regexps for the GitHub API resource paths that MaxAge
+// covers (under a.BasePath and a.UploadsPath), e.g., for grouping
+// apiproxy.CacheStats counts.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, pattern := range []string{publicRepos, repoPath, userPath, userPublicEvents, userReposPath} {
+		res = append(res, a.pathRegexp(pattern))
+	}
+	return res
+}
+
+// pathRegexp compiles a regexp that matches pattern under a.BasePath (or
+// a.UploadsPath).
+func (a *MaxAge) pathRegexp(pattern string) *regexp.Regexp {
+	prefix := regexp.QuoteMeta(strings.TrimSuffix(a.BasePath, "/"))
+	if a.UploadsPath != "" {
+		prefix = `(?:` + prefix + `|` + regexp.QuoteMeta(strings.TrimSuffix(a.UploadsPath, "/")) + `)`
 	}
+	return regexp.MustCompile(`^` + prefix + pattern)
 }
@@ -0,0 +1,40 @@
+package githubproxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaxAge_BasePath(t *testing.T) {
+	tests := []struct {
+		basePath    string
+		uploadsPath string
+		path        string
+		valid       bool
+	}{
+		{"", "", "/repos/foo/bar", true},
+		{"", "", "/api/v3/repos/foo/bar", false},
+		{EnterpriseAPIPath, "", "/api/v3/repos/foo/bar", true},
+		{EnterpriseAPIPath, "", "/api/v3/users/foo/events/public", true},
+		{EnterpriseAPIPath, "", "/repos/foo/bar", false},
+		{EnterpriseAPIPath + "/", "", "/api/v3/user", true},
+		{EnterpriseAPIPath, "", "/api/uploads/repos/foo/bar/releases/1/assets", false},
+		{EnterpriseAPIPath, EnterpriseUploadsPath, "/api/uploads/repos/foo/bar/releases/1/assets", true},
+		{EnterpriseAPIPath, EnterpriseUploadsPath, "/api/v3/repos/foo/bar", true},
+		{EnterpriseAPIPath, EnterpriseUploadsPath, "/repos/foo/bar", false},
+	}
+	for _, test := range tests {
+		v := (&MaxAge{
+			User:        time.Hour,
+			Repository:  time.Hour,
+			Activity:    time.Hour,
+			BasePath:    test.basePath,
+			UploadsPath: test.uploadsPath,
+		}).Validator()
+		valid := v.Valid(&url.URL{Path: test.path}, time.Minute)
+		if test.valid != valid {
+			t.Errorf("base path %q uploads path %q path %s: want valid == %v, got %v", test.basePath, test.uploadsPath, test.path, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package gitlabproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultAPIPath is the path prefix under which GitLab (both gitlab.com and
+// self-managed instances) serves its REST API.
+const DefaultAPIPath = "/api/v4"
+
+// MaxAge represents custom cache max-ages for GitLab API resources. It
+// implements the apiproxy.Validator interface and is intended for use with
+// RevalidationTransport.
+type MaxAge struct {
+	Project         time.Duration
+	User            time.Duration
+	MergeRequests   time.Duration
+	Pipelines       time.Duration
+	RepositoryFiles time.Duration
+	Commits         time.Duration
+
+	// BasePath is the path prefix of the GitLab API. If empty, DefaultAPIPath
+	// is used.
+	BasePath string
+}
+
+// Patterns for GitLab API resource paths, relative to the API base path. They
+// match escaped paths, so a project ID is either numeric or a URL-encoded
+// namespaced path (e.g., group%2Fproject).
+const (
+	projectPath        = `/projects(/[^/]+)?$`
+	userPath           = `/users?(/[^/]+)?$`
+	mergeRequestsPath  = `(/projects/[^/]+)?/merge_requests(/.*)?$`
+	pipelinesPath      = `/projects/[^/]+/pipelines(/.*)?$`
+	repositoryFilePath = `/projects/[^/]+/repository/files/[^/]+(/raw)?$`
+	commitsPath        = `/projects/[^/]+/repository/commits(/.*)?$`
+)
+
+// Validator returns an apiproxy.Validator that implements the MaxAge cache
+// aging logic.
+func (a *MaxAge) Validator() apiproxy.Validator {
+	// PathMatchValidator matches escaped paths, so the slashes in encoded
+	// project paths aren't treated as path separators.
+	return &apiproxy.PathMatchValidator{
+		a.pathRegexp(projectPath):        a.Project,
+		a.pathRegexp(userPath):           a.User,
+		a.pathRegexp(mergeRequestsPath):  a.MergeRequests,
+		a.pathRegexp(pipelinesPath):      a.Pipelines,
+		a.pathRegexp(repositoryFilePath): a.RepositoryFiles,
+		a.pathRegexp(commitsPath):        a.Commits,
+	}
+}
+
+// Patterns returns the regexps for the GitLab API resource paths that MaxAge
+// covers (under the API base path), e.g., for grouping apiproxy.CacheStats
+// counts. Like the apiproxy transports that use them, they match escaped
+// paths.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, pattern := range []string{projectPath, userPath, mergeRequestsPath, pipelinesPath, repositoryFilePath, commitsPath} {
+		res = append(res, a.pathRegexp(pattern))
+	}
+	return res
+}
+
+// pathRegexp compiles a regexp that matches pattern under the API base path.
+func (a *MaxAge) pathRegexp(pattern string) *regexp.Regexp {
+	basePath := a.BasePath
+	if basePath == "" {
+		basePath = DefaultAPIPath
+	}
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(basePath, "/")) + pattern)
+}
@@ -0,0 +1,147 @@
+package gitlabproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"github.com/sourcegraph/httpcache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testMaxAge = &MaxAge{
+	Project:         time.Hour,
+	User:            time.Hour,
+	MergeRequests:   time.Hour,
+	Pipelines:       time.Hour,
+	RepositoryFiles: time.Hour,
+	Commits:         time.Hour,
+}
+
+func TestMaxAge_Validator(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"/api/v4/projects", true},
+		{"/api/v4/projects/123", true},
+		{"/api/v4/projects/group%2Fproject", true},
+		{"/api/v4/projects/group%2Fsubgroup%2Fproject/merge_requests", true},
+		{"/api/v4/projects/group%2Fproject/merge_requests/1/changes", true},
+		{"/api/v4/merge_requests", true},
+		{"/api/v4/projects/123/pipelines/456/jobs", true},
+		{"/api/v4/projects/group%2Fproject/repository/files/src%2Fmain.go/raw", true},
+		{"/api/v4/projects/group%2Fproject/repository/commits/abc123", true},
+		{"/api/v4/user", true},
+		{"/api/v4/users/42", true},
+		{"/api/v4/projects/group%2Fproject/issues", false},
+		{"/api/v4/projects/group/project", false},
+		{"/projects/123", false},
+	}
+	v := testMaxAge.Validator()
+	for _, test := range tests {
+		u, err := url.Parse("https://gitlab.example.com" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := v.Valid(u, time.Minute); test.valid != valid {
+			t.Errorf("path %s: want valid == %v, got %v", test.path, test.valid, valid)
+		}
+		if valid := v.Valid(u, 2*time.Hour); valid {
+			t.Errorf("path %s: want expired entry to be invalid", test.path)
+		}
+	}
+}
+
+func TestMaxAge_RevalidationTransport(t *testing.T) {
+	// Start a fake GitLab server whose responses are always stale, so that the
+	// caching transport always tries to revalidate them.
+	requestCount := make(map[string]int)
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount[r.URL.EscapedPath()]++
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{}`))
+	}))
+	defer gitlab.Close()
+
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = &apiproxy.RevalidationTransport{Check: testMaxAge.Validator()}
+	client := &http.Client{Transport: cachingTransport}
+
+	tests := []struct {
+		path             string
+		wantRequestCount int
+	}{
+		// The validator extends the max-age of merge requests, so they are
+		// only fetched once.
+		{"/api/v4/projects/group%2Fproject/merge_requests", 1},
+		// Issues aren't covered by MaxAge, so they are revalidated each time.
+		{"/api/v4/projects/group%2Fproject/issues", 2},
+	}
+	for _, test := range tests {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(gitlab.URL + test.path)
+			if err != nil {
+				t.Fatal("Get", err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if got := requestCount[test.path]; test.wantRequestCount != got {
+			t.Errorf("path %s: want %d requests to GitLab, got %d", test.path, test.wantRequestCount, got)
+		}
+	}
+}
+
+func TestMaxAge_Rule(t *testing.T) {
+	rule, ok := testMaxAge.Validator().(apiproxy.ValidatorRule)
+	if !ok {
+		t.Fatal("want Validator to implement apiproxy.ValidatorRule")
+	}
+	u, err := url.Parse("https://gitlab.example.com/api/v4/projects/group%2Fproject/merge_requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := testMaxAge.pathRegexp(mergeRequestsPath).String(), rule.Rule(u); want != got {
+		t.Errorf("want rule %q, got %q", want, got)
+	}
+}
+
+func TestMaxAge_Patterns(t *testing.T) {
+	// Route patterns apply to namespaced project paths, e.g., in rate limits.
+	transport := &apiproxy.RateLimitTransport{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	for _, pattern := range testMaxAge.Patterns() {
+		transport.Routes = append(transport.Routes, apiproxy.RouteRateLimit{
+			Pattern: pattern,
+			Limit:   apiproxy.RateLimit{Rate: 0.001, Burst: 1},
+		})
+	}
+	var codes []int
+	for _, path := range []string{"/projects/group%2Fproject/merge_requests", "/projects/group%2Fproject/merge_requests", "/projects/group%2Fproject/issues"} {
+		req, err := http.NewRequest("GET", "https://gitlab.example.com/api/v4"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		codes = append(codes, resp.StatusCode)
+	}
+	if want := []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK}; !reflect.DeepEqual(want, codes) {
+		t.Errorf("want status codes %v, got %v", want, codes)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
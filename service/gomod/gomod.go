@@ -0,0 +1,61 @@
+package gomodproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxAge represents custom cache max-ages for Go module proxy protocol
+// resources (see https://go.dev/ref/mod#goproxy-protocol). It implements the
+// apiproxy.Validator interface and is intended for use with
+// RevalidationTransport.
+//
+// A module version's .info, .mod and .zip files are immutable, so cached
+// copies of them are always valid. Requests for these files that name a
+// version query (e.g., a branch name such as master) instead of a canonical
+// version are mutable and are treated like List.
+type MaxAge struct {
+	// List is the max-age of the mutable version queries ($module/@v/list,
+	// $module/@latest and $module/@v/$query.info, .mod and .zip for
+	// non-canonical versions), which change when new versions are tagged.
+	List time.Duration
+
+	// BasePath is the path prefix of the module proxy. It is empty for
+	// proxy.golang.org.
+	BasePath string
+}
+
+// Patterns for module proxy paths, relative to the proxy base path.
+const (
+	versionPath = `/.+/@v/v\d+\.\d+\.\d+[^/]*\.(info|mod|zip)$`
+	listPath    = `/.+/(@v/list|@latest|@v/[^/]+\.(info|mod|zip))$`
+)
+
+// Validator returns an apiproxy.Validator that implements the MaxAge cache
+// aging logic.
+func (a *MaxAge) Validator() apiproxy.Validator {
+	version, list := a.pathRegexp(versionPath), a.pathRegexp(listPath)
+	return apiproxy.ValidatorFunc(func(u *url.URL, age time.Duration) bool {
+		switch {
+		case version.MatchString(u.EscapedPath()):
+			return true
+		case list.MatchString(u.EscapedPath()):
+			return age <= a.List
+		}
+		return false
+	})
+}
+
+// Patterns returns the regexps for the module proxy paths that MaxAge covers
+// (under a.BasePath), e.g., for grouping apiproxy.CacheStats counts.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	return []*regexp.Regexp{a.pathRegexp(versionPath), a.pathRegexp(listPath)}
+}
+
+// pathRegexp compiles a regexp that matches pattern under a.BasePath.
+func (a *MaxAge) pathRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(a.BasePath, "/")) + pattern)
+}
@@ -0,0 +1,37 @@
+package gomodproxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaxAge_Validator(t *testing.T) {
+	tests := []struct {
+		basePath string
+		path     string
+		age      time.Duration
+		valid    bool
+	}{
+		{"", "/github.com/!burnt!sushi/toml/@v/v1.3.2.info", 365 * 24 * time.Hour, true},
+		{"", "/github.com/!burnt!sushi/toml/@v/v1.3.2.mod", 365 * 24 * time.Hour, true},
+		{"", "/golang.org/x/net/@v/v0.17.0.zip", 365 * 24 * time.Hour, true},
+		{"", "/golang.org/x/net/@v/v0.0.0-20231010123456-abcdef123456.zip", 365 * 24 * time.Hour, true},
+		{"", "/golang.org/x/net/@v/master.info", time.Minute, true},
+		{"", "/golang.org/x/net/@v/master.info", time.Hour, false},
+		{"", "/golang.org/x/net/@v/v1.info", time.Hour, false},
+		{"", "/golang.org/x/net/@v/list", time.Minute, true},
+		{"", "/golang.org/x/net/@v/list", time.Hour, false},
+		{"", "/golang.org/x/net/@latest", time.Minute, true},
+		{"", "/golang.org/x/net/@latest", time.Hour, false},
+		{"", "/sumdb/sum.golang.org/latest", time.Minute, false},
+		{"/goproxy", "/goproxy/golang.org/x/net/@v/v0.17.0.zip", 365 * 24 * time.Hour, true},
+		{"/goproxy", "/golang.org/x/net/@v/v0.17.0.zip", 365 * 24 * time.Hour, false},
+	}
+	for _, test := range tests {
+		v := (&MaxAge{List: 5 * time.Minute, BasePath: test.basePath}).Validator()
+		if valid := v.Valid(&url.URL{Path: test.path}, test.age); test.valid != valid {
+			t.Errorf("base path %q path %s age %s: want valid == %v, got %v", test.basePath, test.path, test.age, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package npmproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxAge represents custom cache max-ages for npm registry resources. It
+// implements the apiproxy.Validator interface and is intended for use with
+// RevalidationTransport.
+//
+// Package tarballs are immutable (a published version can never be
+// overwritten), so cached tarballs are always valid.
+type MaxAge struct {
+	// Metadata is the max-age of package metadata documents (e.g., /express,
+	// /@types%2fnode and /express/latest), which change when versions or
+	// dist-tags are published.
+	Metadata time.Duration
+
+	// BasePath is the path prefix of the registry. It is empty for
+	// registry.npmjs.org.
+	BasePath string
+}
+
+// Patterns for npm registry paths, relative to the registry base path. They
+// match escaped paths, in which scoped package names (@scope/name) may be
+// URL-encoded as @scope%2fname.
+const (
+	tarballPath  = `/(@[^/]+(/|%2[fF]))?[^/@][^/]*/-/[^/]+\.tgz$`
+	metadataPath = `/(@[^/]+(/|%2[fF]))?[^/@-][^/]*(/[^/-][^/]*)?$`
+)
+
+// Validator returns an apiproxy.Validator that implements the MaxAge cache
+// aging logic.
+func (a *MaxAge) Validator() apiproxy.Validator {
+	tarball, metadata := a.pathRegexp(tarballPath), a.pathRegexp(metadataPath)
+	return apiproxy.ValidatorFunc(func(u *url.URL, age time.Duration) bool {
+		switch {
+		case tarball.MatchString(u.EscapedPath()):
+			return true
+		case metadata.MatchString(u.EscapedPath()):
+			return age <= a.Metadata
+		}
+		return false
+	})
+}
+
+// Patterns returns the regexps for the npm registry paths that MaxAge covers
+// (under a.BasePath), e.g., for grouping apiproxy.CacheStats counts.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	return []*regexp.Regexp{a.pathRegexp(tarballPath), a.pathRegexp(metadataPath)}
+}
+
+// pathRegexp compiles a regexp that matches pattern under a.BasePath.
+func (a *MaxAge) pathRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(a.BasePath, "/")) + pattern)
+}
@@ -0,0 +1,37 @@
+package npmproxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaxAge_Validator(t *testing.T) {
+	tests := []struct {
+		path  string
+		age   time.Duration
+		valid bool
+	}{
+		{"/express/-/express-4.18.2.tgz", 365 * 24 * time.Hour, true},
+		{"/@types/node/-/node-20.1.0.tgz", 365 * 24 * time.Hour, true},
+		{"/express", time.Minute, true},
+		{"/express", time.Hour, false},
+		{"/express/latest", time.Minute, true},
+		{"/@types%2fnode", time.Minute, true},
+		{"/@types%2fnode", time.Hour, false},
+		{"/@types%2Fnode", time.Minute, true},
+		{"/@types/node/20.1.0", time.Minute, true},
+		{"/-/v1/search", time.Minute, false},
+		{"/-/whoami", time.Minute, false},
+	}
+	v := (&MaxAge{Metadata: 5 * time.Minute}).Validator()
+	for _, test := range tests {
+		u, err := url.Parse("https://registry.npmjs.org" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := v.Valid(u, test.age); test.valid != valid {
+			t.Errorf("path %s age %s: want valid == %v, got %v", test.path, test.age, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package ociproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sourcegraph/httpcache"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// BlobTransport is an implementation of net/http.RoundTripper that caches
+// registry blobs (image layers and configs) on disk.
+//
+// Blobs can be gigabytes in size, so they are not suitable for caches that
+// buffer responses in memory (such as httpcache). BlobTransport streams each
+// fetched blob to the client and to a file in Dir at the same time, and keeps
+// the file only if its content matches the blob's sha256 digest. Later
+// requests for the blob (in any repository) are served from the file.
+//
+// Note that blobs served from disk are not subject to the registry's access
+// control, so a BlobTransport should only be shared by clients with access to
+// the same repositories.
+type BlobTransport struct {
+	// Dir is the directory in which blobs are stored.
+	Dir string
+
+	// Blobs is the transport used to fetch blobs that aren't on disk from the
+	// registry. It should not cache responses in memory. If nil, Transport is
+	// used.
+	Blobs http.RoundTripper
+
+	// Redirects is the transport used to follow the registry's redirects of
+	// blob requests (e.g., to a CDN). It should not cache responses in memory
+	// or send registry credentials. If nil, net/http.DefaultTransport is used.
+	Redirects http.RoundTripper
+
+	// Transport is the underlying transport for all requests other than blob
+	// GET and HEAD requests. If nil, net/http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// blobPath matches sha256 blob paths, capturing the hex digest.
+var blobPath = regexp.MustCompile(`^/v2/.+/blobs/sha256:([a-f0-9]{64})$`)
+
+// maxBlobRedirects is the maximum number of redirects followed when fetching a
+// blob. Registries often redirect blob requests to a CDN.
+const maxBlobRedirects = 5
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *BlobTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	m := blobPath.FindStringSubmatch(req.URL.Path)
+	if m == nil || (req.Method != "GET" && req.Method != "HEAD") || req.Header.Get("Range") != "" {
+		return transport.RoundTrip(req)
+	}
+	digest := m[1]
+	filename := filepath.Join(t.Dir, "sha256", digest)
+
+	if f, err := os.Open(filename); err == nil {
+		return blobResponse(req, f, digest)
+	}
+
+	blobs := t.Blobs
+	if blobs == nil {
+		blobs = transport
+	}
+	redirects := t.Redirects
+	if redirects == nil {
+		redirects = http.DefaultTransport
+	}
+	resp, err = blobs.RoundTrip(req)
+	for i := 0; err == nil && i < maxBlobRedirects && isRedirect(resp.StatusCode); i++ {
+		var loc *http.Request
+		if loc, err = redirectRequest(req, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		resp, err = redirects.RoundTrip(loc)
+	}
+	if err != nil || req.Method != "GET" || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return resp, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), digest+".tmp")
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body = &blobWriter{
+		body:     resp.Body,
+		file:     tmp,
+		hash:     sha256.New(),
+		digest:   digest,
+		filename: filename,
+	}
+	return resp, nil
+}
+
+// blobResponse returns a response for the blob stored in f.
+func blobResponse(req *http.Request, f *os.File, digest string) (*http.Response, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: fi.Size(),
+		Request:       req,
+		Body:          f,
+	}
+	resp.Header.Set("Content-Type", "application/octet-stream")
+	resp.Header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	resp.Header.Set("Docker-Content-Digest", "sha256:"+digest)
+	resp.Header.Set(httpcache.XFromCache, "1")
+	if req.Method == "HEAD" {
+		f.Close()
+		resp.Body = http.NoBody
+	}
+	return resp, nil
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectRequest returns a request for the Location of the redirect response
+// resp to req.
+func redirectRequest(req *http.Request, resp *http.Response) (*http.Request, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("blob redirect: %s", err)
+	}
+	req2, err := http.NewRequest(req.Method, loc.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		req2.Header.Set("User-Agent", ua)
+	}
+	return req2.WithContext(req.Context()), nil
+}
+
+// blobWriter is an io.ReadCloser that copies a blob's contents to a file as
+// they are read. When the whole blob has been read and its digest verified,
+// the file is moved to filename.
+type blobWriter struct {
+	body     io.ReadCloser
+	file     *os.File
+	hash     hash.Hash
+	digest   string
+	filename string
+	failed   bool
+	done     bool
+}
+
+func (w *blobWriter) Read(p []byte) (n int, err error) {
+	n, err = w.body.Read(p)
+	if n > 0 && !w.failed {
+		w.hash.Write(p[:n])
+		if _, werr := w.file.Write(p[:n]); werr != nil {
+			w.failed = true
+		}
+	}
+	if err == io.EOF {
+		w.finish()
+	}
+	return
+}
+
+func (w *blobWriter) Close() error {
+	w.finish()
+	return w.body.Close()
+}
+
+// finish moves the file into place if its digest matches, and removes it
+// otherwise. It is called at EOF and on Close (which may happen before EOF, in
+// which case the partial blob's digest won't match).
+func (w *blobWriter) finish() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	name := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		w.failed = true
+	}
+	if w.failed || hex.EncodeToString(w.hash.Sum(nil)) != w.digest || os.Rename(name, w.filename) != nil {
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,99 @@
+package ociproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sourcegraph/httpcache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobTransport(t *testing.T) {
+	blob := []byte("layer contents")
+	sum := sha256.Sum256(blob)
+	digest := hex.EncodeToString(sum[:])
+	badDigest := hex.EncodeToString(make([]byte, 32))
+
+	blobRequests := 0
+	registryMux := http.NewServeMux()
+	registryMux.HandleFunc("/v2/library/ubuntu/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		// Registries typically redirect blob requests to a CDN.
+		http.Redirect(w, r, "/cdn/"+filepath.Base(r.URL.Path), http.StatusTemporaryRedirect)
+	})
+	registryMux.HandleFunc("/cdn/", func(w http.ResponseWriter, r *http.Request) {
+		blobRequests++
+		w.Write(blob)
+	})
+	registry := httptest.NewServer(registryMux)
+	defer registry.Close()
+
+	dir, err := ioutil.TempDir("", "apiproxy-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Blob requests (and only blob requests) bypass Transport.
+	var transportRequests, redirectRequests int
+	transport := &BlobTransport{
+		Dir: dir,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			transportRequests++
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+		Redirects: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			redirectRequests++
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+		Blobs: http.DefaultTransport,
+	}
+
+	get := func(digest string) *http.Response {
+		req, err := http.NewRequest("GET", registry.URL+"/v2/library/ubuntu/blobs/sha256:"+digest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		defer resp.Body.Close()
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != string(blob) {
+			t.Errorf("want blob %q, got %q", blob, body)
+		}
+		return resp
+	}
+
+	// The first request fetches the blob (following the redirect) and stores
+	// it; the second is served from disk.
+	if resp := get(digest); resp.Header.Get(httpcache.XFromCache) != "" {
+		t.Error("want first response not to be from cache")
+	}
+	if resp := get(digest); resp.Header.Get(httpcache.XFromCache) == "" {
+		t.Error("want second response to be from cache")
+	}
+	if blobRequests != 1 {
+		t.Errorf("want 1 blob request, got %d", blobRequests)
+	}
+	if transportRequests != 0 || redirectRequests != 1 {
+		t.Errorf("want 0 requests via Transport and 1 via Redirects, got %d and %d", transportRequests, redirectRequests)
+	}
+
+	// Blobs whose content doesn't match their digest aren't stored.
+	get(badDigest)
+	get(badDigest)
+	if blobRequests != 3 {
+		t.Errorf("want 3 blob requests, got %d", blobRequests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sha256", badDigest)); !os.IsNotExist(err) {
+		t.Errorf("want blob with bad digest not to be stored, got Stat error %v", err)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
@@ -0,0 +1,63 @@
+// Package ociproxy provides caching policies and transports for proxying OCI
+// distribution (Docker) registries, so that apiproxy can act as a
+// pull-through cache.
+package ociproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// MaxAge represents custom cache max-ages for OCI distribution registry
+// resources. It implements the apiproxy.Validator interface and is intended
+// for use with RevalidationTransport.
+//
+// Content addressed by digest (manifests fetched by digest, and all blobs) is
+// immutable, so cached copies of it are always valid.
+type MaxAge struct {
+	// Tag is the max-age of manifests fetched by tag (e.g.,
+	// /v2/library/ubuntu/manifests/22.04) and of tag lists, which change when
+	// images are pushed.
+	Tag time.Duration
+}
+
+// Regexps for OCI distribution API paths.
+var (
+	digestPath = regexp.MustCompile(`^/v2/.+/(manifests|blobs)/[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+	tagPath    = regexp.MustCompile(`^/v2/.+/(manifests/[^/:]+|tags/list)$`)
+)
+
+// Validator returns an apiproxy.Validator that implements the MaxAge cache
+// aging logic.
+func (a *MaxAge) Validator() apiproxy.Validator {
+	return apiproxy.ValidatorFunc(func(u *url.URL, age time.Duration) bool {
+		switch {
+		case digestPath.MatchString(u.EscapedPath()):
+			return true
+		case tagPath.MatchString(u.EscapedPath()):
+			return age <= a.Tag
+		}
+		return false
+	})
+}
+
+// Patterns returns the regexps for the registry paths that MaxAge covers,
+// e.g., for grouping apiproxy.CacheStats counts.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	return []*regexp.Regexp{digestPath, tagPath}
+}
+
+// repositoryPath matches OCI distribution API paths that refer to a
+// repository, capturing the repository name.
+var repositoryPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/`)
+
+// repositoryName returns the name of the repository (e.g., library/ubuntu)
+// that path refers to, or the empty string if it doesn't refer to one.
+func repositoryName(path string) string {
+	if m := repositoryPath.FindStringSubmatch(path); m != nil {
+		return m[1]
+	}
+	return ""
+}
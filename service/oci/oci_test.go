@@ -0,0 +1,32 @@
+package ociproxy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxAge_Validator(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		path  string
+		age   time.Duration
+		valid bool
+	}{
+		{"/v2/library/ubuntu/manifests/" + digest, 365 * 24 * time.Hour, true},
+		{"/v2/library/ubuntu/blobs/" + digest, 365 * 24 * time.Hour, true},
+		{"/v2/library/ubuntu/manifests/22.04", 30 * time.Second, true},
+		{"/v2/library/ubuntu/manifests/22.04", 5 * time.Minute, false},
+		{"/v2/library/ubuntu/tags/list", 30 * time.Second, true},
+		{"/v2/library/ubuntu/tags/list", 5 * time.Minute, false},
+		{"/v2/", time.Second, false},
+		{"/v2/_catalog", time.Second, false},
+	}
+	v := (&MaxAge{Tag: time.Minute}).Validator()
+	for _, test := range tests {
+		if valid := v.Valid(&url.URL{Path: test.path}, test.age); test.valid != valid {
+			t.Errorf("path %s age %s: want valid == %v, got %v", test.path, test.age, test.valid, valid)
+		}
+	}
+}
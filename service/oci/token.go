@@ -0,0 +1,234 @@
+package ociproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenTransport is an implementation of net/http.RoundTripper that handles
+// registry token authentication (see
+// https://distribution.github.io/distribution/spec/auth/token/)
+// transparently.
+//
+// When the registry responds 401 Unauthorized with a WWW-Authenticate Bearer
+// challenge, TokenTransport fetches a token from the challenge's realm and
+// retries the request with it. Tokens are reused for later requests to the same
+// repository until they expire (or until the registry rejects them, in which
+// case a new token is fetched and the request is retried once).
+type TokenTransport struct {
+	// Username and Password are sent to the token realm using HTTP Basic
+	// authentication. If Username is empty, tokens are requested anonymously.
+	// Credentials are only sent to https realms, so that a tampered challenge
+	// can't make them be sent in cleartext.
+	Username string
+	Password string
+
+	// Transport is the underlying transport. If nil, net/http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	tokens   map[string]token // host and repository name -> token
+	tokensMu sync.Mutex
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// defaultTokenLifetime is the lifetime of tokens whose response doesn't
+// specify expires_in, per the token authentication spec.
+const defaultTokenLifetime = 60 * time.Second
+
+// RoundTrip implements net/http.RoundTripper.
+func (t *TokenTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.transport().RoundTrip(req)
+	}
+
+	key := req.URL.Host + "/" + repositoryName(req.URL.Path)
+	tok, present := t.token(key)
+	if present {
+		resp, err = t.transport().RoundTrip(withBearerToken(req, tok))
+	} else {
+		resp, err = t.transport().RoundTrip(req)
+	}
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return
+	}
+	if present {
+		// The token has been revoked or has expired early, so get a new one.
+		t.deleteToken(key, tok)
+	}
+	challenge, isBearer := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !isBearer {
+		return
+	}
+
+	newTok, err := t.fetchToken(challenge)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.tokensMu.Lock()
+	if t.tokens == nil {
+		t.tokens = make(map[string]token)
+	}
+	t.tokens[key] = newTok
+	t.tokensMu.Unlock()
+
+	req2 := withBearerToken(req, newTok.value)
+	if req.GetBody != nil {
+		if req2.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.transport().RoundTrip(req2)
+}
+
+func (t *TokenTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// token returns the unexpired token for key, if any.
+func (t *TokenTransport) token(key string) (string, bool) {
+	t.tokensMu.Lock()
+	defer t.tokensMu.Unlock()
+	tok, present := t.tokens[key]
+	if !present || time.Now().After(tok.expires) {
+		return "", false
+	}
+	return tok.value, true
+}
+
+// deleteToken deletes the token for key if it is still tok.
+func (t *TokenTransport) deleteToken(key, tok string) {
+	t.tokensMu.Lock()
+	defer t.tokensMu.Unlock()
+	if t.tokens[key].value == tok {
+		delete(t.tokens, key)
+	}
+}
+
+// fetchToken requests a token from the realm of the challenge.
+func (t *TokenTransport) fetchToken(challenge map[string]string) (token, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return token{}, fmt.Errorf("invalid token realm %q", challenge["realm"])
+	}
+	q := realm.Query()
+	for _, param := range []string{"service", "scope"} {
+		if v := challenge[param]; v != "" {
+			q.Set(param, v)
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return token{}, err
+	}
+	if t.Username != "" {
+		if realm.Scheme != "https" {
+			return token{}, fmt.Errorf("refusing to send registry credentials to non-https token realm %q", challenge["realm"])
+		}
+		req.SetBasicAuth(t.Username, t.Password)
+	}
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		return token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("token request to %s: %s", realm.Host, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return token{}, err
+	}
+	tok := token{value: body.Token, expires: time.Now().Add(defaultTokenLifetime)}
+	if tok.value == "" {
+		tok.value = body.AccessToken
+	}
+	if body.ExpiresIn > 0 {
+		tok.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
+
+// withBearerToken returns a clone of req with an Authorization header for tok.
+func withBearerToken(req *http.Request, tok string) *http.Request {
+	req2 := *req
+	req2.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	req2.Header.Set("Authorization", "Bearer "+tok)
+	return &req2
+}
+
+// parseBearerChallenge parses a WWW-Authenticate header value such as `Bearer
+// realm="https://auth.docker.io/token",service="registry.docker.io"` and
+// returns its parameters. If the challenge's scheme isn't Bearer, isBearer is
+// false.
+func parseBearerChallenge(header string) (params map[string]string, isBearer bool) {
+	const scheme = "bearer "
+	if len(header) < len(scheme) || strings.ToLower(header[:len(scheme)]) != scheme {
+		return nil, false
+	}
+	params = make(map[string]string)
+	s := header[len(scheme):]
+	for {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq == -1 {
+			return params, true
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			// Quoted values may contain commas (e.g., scope="...:pull,push").
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end], s[end+1:]
+			}
+			value = strings.Replace(value, `\`, "", -1)
+		} else {
+			end := strings.Index(s, ",")
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+}
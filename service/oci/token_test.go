@@ -0,0 +1,119 @@
+package ociproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTokenTransport(t *testing.T) {
+	tokenRequests := 0
+	validToken := "t0k3n"
+	var registry *httptest.Server
+	registry = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			if user, pass, _ := r.BasicAuth(); user != "alice" || pass != "secret" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			if want, got := "repository:library/ubuntu:pull", r.URL.Query().Get("scope"); want != got {
+				t.Errorf("want token scope %q, got %q", want, got)
+			}
+			fmt.Fprintf(w, `{"token":%q,"expires_in":300}`, validToken)
+		case "/v2/library/ubuntu/manifests/latest":
+			if r.Header.Get("Authorization") != "Bearer "+validToken {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:library/ubuntu:pull"`, registry.URL))
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "manifest")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	transport := &TokenTransport{Username: "alice", Password: "secret", Transport: registry.Client().Transport}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Revoke the cached token.
+			validToken = "n3w"
+		}
+		req, err := http.NewRequest("GET", registry.URL+"/v2/library/ubuntu/manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "manifest" {
+			t.Errorf("request %d: want 200 manifest, got %d %q", i, resp.StatusCode, body)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("request %d: want original request not to be modified", i)
+		}
+	}
+
+	// The token should be reused for the second request, and replaced when
+	// it is revoked.
+	if tokenRequests != 2 {
+		t.Errorf("want 2 token requests, got %d", tokenRequests)
+	}
+}
+
+func TestTokenTransport_InsecureRealm(t *testing.T) {
+	var credentialsSent bool
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, credentialsSent = r.BasicAuth()
+		fmt.Fprint(w, `{"token":"t0k3n"}`)
+	}))
+	defer realm.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, realm.URL))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+
+	// Credentials aren't sent to a plain http realm.
+	transport := &TokenTransport{Username: "alice", Password: "secret"}
+	req, err := http.NewRequest("GET", registry.URL+"/v2/library/ubuntu/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Error("want RoundTrip error for non-https realm")
+	}
+	if credentialsSent {
+		t.Error("want credentials not to be sent to non-https realm")
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	tests := []struct {
+		header   string
+		params   map[string]string
+		isBearer bool
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull,push"`,
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/ubuntu:pull,push"},
+			true,
+		},
+		{`bearer realm=https://example.com/token, service="x"`, map[string]string{"realm": "https://example.com/token", "service": "x"}, true},
+		{`Basic realm="registry"`, nil, false},
+	}
+	for _, test := range tests {
+		params, isBearer := parseBearerChallenge(test.header)
+		if test.isBearer != isBearer || !reflect.DeepEqual(test.params, params) {
+			t.Errorf("%s: want %v (bearer %v), got %v (bearer %v)", test.header, test.params, test.isBearer, params, isBearer)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package pypiproxy
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxAge represents custom cache max-ages for Python Package Index resources.
+// It implements the apiproxy.Validator interface and is intended for use with
+// RevalidationTransport.
+//
+// Distribution files (wheels and sdists under /packages/, as served by
+// files.pythonhosted.org) are immutable, so cached files are always valid.
+type MaxAge struct {
+	// Index is the max-age of the simple repository API (/simple/ and
+	// /simple/<project>/), which changes when releases are uploaded or
+	// yanked.
+	Index time.Duration
+
+	// JSON is the max-age of the JSON API (/pypi/<project>/json and
+	// /pypi/<project>/<version>/json).
+	JSON time.Duration
+
+	// BasePath is the path prefix of the index. It is empty for pypi.org.
+	BasePath string
+}
+
+// Patterns for PyPI paths, relative to the index base path.
+const (
+	filePath   = `/packages/.+/[^/]+\.(whl|tar\.gz|zip|tar\.bz2|egg)(\.metadata)?$`
+	simplePath = `/simple(/[^/]+)?/?$`
+	jsonPath   = `/pypi/[^/]+(/[^/]+)?/json/?$`
+)
+
+// Validator returns an apiproxy.Validator that implements the MaxAge cache
+// aging logic.
+func (a *MaxAge) Validator() apiproxy.Validator {
+	file, simple, json := a.pathRegexp(filePath), a.pathRegexp(simplePath), a.pathRegexp(jsonPath)
+	return apiproxy.ValidatorFunc(func(u *url.URL, age time.Duration) bool {
+		switch {
+		case file.MatchString(u.EscapedPath()):
+			return true
+		case simple.MatchString(u.EscapedPath()):
+			return age <= a.Index
+		case json.MatchString(u.EscapedPath()):
+			return age <= a.JSON
+		}
+		return false
+	})
+}
+
+// Patterns returns the regexps for the PyPI paths that MaxAge covers (under
+// a.BasePath), e.g., for grouping apiproxy.CacheStats counts.
+func (a *MaxAge) Patterns() []*regexp.Regexp {
+	return []*regexp.Regexp{a.pathRegexp(filePath), a.pathRegexp(simplePath), a.pathRegexp(jsonPath)}
+}
+
+// pathRegexp compiles a regexp that matches pattern under a.BasePath.
+func (a *MaxAge) pathRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(a.BasePath, "/")) + pattern)
+}
@@ -0,0 +1,36 @@
+package pypiproxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaxAge_Validator(t *testing.T) {
+	tests := []struct {
+		path  string
+		age   time.Duration
+		valid bool
+	}{
+		{"/packages/py3/r/requests/requests-2.31.0-py3-none-any.whl", 365 * 24 * time.Hour, true},
+		{"/packages/9d/be/10918a2eac4ae9f02f6cfe6414b7a155ccd8f7f9d4380d62fd5b955065c3/requests-2.31.0.tar.gz", 365 * 24 * time.Hour, true},
+		{"/packages/py3/r/requests/requests-2.31.0-py3-none-any.whl.metadata", 365 * 24 * time.Hour, true},
+		{"/simple/", time.Minute, true},
+		{"/simple/requests/", time.Minute, true},
+		{"/simple/requests/", time.Hour, false},
+		{"/pypi/requests/json", 5 * time.Minute, true},
+		{"/pypi/requests/json", 20 * time.Minute, false},
+		{"/pypi/requests/2.31.0/json", 5 * time.Minute, true},
+		{"/search/", time.Minute, false},
+	}
+	v := (&MaxAge{Index: 5 * time.Minute, JSON: 10 * time.Minute}).Validator()
+	for _, test := range tests {
+		u, err := url.Parse("https://pypi.org" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := v.Valid(u, test.age); test.valid != valid {
+			t.Errorf("path %s age %s: want valid == %v, got %v", test.path, test.age, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package apiproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// CacheOutcome describes how a request through a caching transport was
+// served.
+type CacheOutcome string
+
+const (
+	// CacheHit means the response was served from the cache without
+	// contacting the upstream server.
+	CacheHit CacheOutcome = "hit"
+
+	// CacheSynthesized means the cache entry was stale, but
+	// RevalidationTransport's Validator deemed it valid and synthesized a 304
+	// Not Modified response instead of contacting the upstream server.
+	CacheSynthesized CacheOutcome = "synthesized-304"
+
+	// CacheRevalidated means the upstream server responded 304 Not Modified
+	// to a conditional request for a stale cache entry.
+	CacheRevalidated CacheOutcome = "revalidated"
+
+	// CacheMiss means the upstream server sent a full response.
+	CacheMiss CacheOutcome = "miss"
+)
+
+// CacheCounts are the numbers of requests that were served in each way by a
+// caching transport.
+type CacheCounts struct {
+	// Cached is the number of requests served from the cache without
+	// contacting the upstream server (including 304 responses synthesized by
+	// RevalidationTransport).
+	Cached int64
+
+	// Revalidated is the number of requests for which the upstream server
+	// responded 304 Not Modified to a conditional request.
+	Revalidated int64
+
+	// Fetched is the number of requests for which the upstream server sent a
+	// full response.
+	Fetched int64
+
+	// RateLimitSaved is the number of rate-limit units saved, assuming (as with
+	// GitHub's API) that each full response costs one unit and cached and 304
+	// responses cost nothing.
+	RateLimitSaved int64
+}
+
+// CacheEvent describes a request that was served through a caching transport
+// wrapped by CacheStats.
+type CacheEvent struct {
+	Request *http.Request
+
+	// Pattern is the path pattern that the request was grouped under.
+	Pattern string
+
+	Outcome CacheOutcome
+
+	// Duration is the total time taken to serve the request (excluding reading
+	// the response body).
+	Duration time.Duration
+
+	// UpstreamStatusCode is the status code of the upstream response, or 0 if
+	// the upstream server wasn't contacted.
+	UpstreamStatusCode int
+
+	// UpstreamDuration is the time taken by the upstream request.
+	UpstreamDuration time.Duration
+
+	// Rule describes the RevalidationTransport Validator rule that was applied
+	// to a stale cache entry for the request, if the Validator implements
+	// ValidatorRule.
+	Rule string
+}
+
+// CacheStats records how GET and HEAD requests through a caching transport
+// were served, grouped by path pattern. Use Transport to wrap the caching
+// transport and UpstreamTransport to wrap the transport beneath it, e.g.:
+//
+//	stats := &apiproxy.CacheStats{Patterns: patterns}
+//	cachingTransport := httpcache.NewTransport(cache)
+//	cachingTransport.Transport = stats.UpstreamTransport(nil)
+//	client := &http.Client{Transport: stats.Transport(cachingTransport)}
+//
+// CacheStats is an http.Handler that serves a JSON snapshot of its counts.
+type CacheStats struct {
+	// Patterns are the path regexps that requests are grouped by. A request is
+	// counted under the first pattern that matches its escaped path (see
+	// net/url.URL.EscapedPath), or the empty string if none match.
+	Patterns []*regexp.Regexp
+
+	// OnRequest, if non-nil, is called after each GET or HEAD request is
+	// served.
+	OnRequest func(e CacheEvent)
+
+	counts map[string]*CacheCounts
+	mu     sync.Mutex
+}
+
+// upstreamResultKey is the request context key for an *upstreamResult.
+type upstreamResultKey struct{}
+
+// upstreamResult records whether a request was sent upstream, and the status
+// of the upstream response.
+type upstreamResult struct {
+	contacted   bool
+	synthesized bool
+	statusCode  int
+	duration    time.Duration
+
+	// rule is the ValidatorRule description of the rule that
+	// RevalidationTransport's Validator applied to the request, if any.
+	rule string
+}
+
+// requestUpstreamResult returns the *upstreamResult in req's context, or nil if
+// there is none.
+func requestUpstreamResult(req *http.Request) *upstreamResult {
+	result, _ := req.Context().Value(upstreamResultKey{}).(*upstreamResult)
+	return result
+}
+
+// withUpstreamResult returns req with an *upstreamResult in its context (and
+// the result). If req's context already has one, req is returned unchanged.
+func withUpstreamResult(req *http.Request) (*http.Request, *upstreamResult) {
+	if result := requestUpstreamResult(req); result != nil {
+		return req, result
+	}
+	result := new(upstreamResult)
+	return req.WithContext(context.WithValue(req.Context(), upstreamResultKey{}, result)), result
+}
+
+// outcome returns the cache outcome of a request with result r.
+func (r *upstreamResult) outcome() CacheOutcome {
+	switch {
+	case r.synthesized:
+		return CacheSynthesized
+	case !r.contacted:
+		return CacheHit
+	case r.statusCode == http.StatusNotModified:
+		return CacheRevalidated
+	}
+	return CacheMiss
+}
+
+// Transport returns a transport that records the outcome of requests to the
+// caching transport t. If t is nil, net/http.DefaultTransport is used.
+func (s *CacheStats) Transport(t http.RoundTripper) http.RoundTripper {
+	return &cacheStatsTransport{s, t}
+}
+
+// UpstreamTransport returns a transport that records upstream responses, for
+// use as the underlying transport of the caching transport. If t is nil,
+// net/http.DefaultTransport is used.
+func (s *CacheStats) UpstreamTransport(t http.RoundTripper) http.RoundTripper {
+	return &upstreamStatsTransport{t}
+}
+
+type cacheStatsTransport struct {
+	stats     *CacheStats
+	transport http.RoundTripper
+}
+
+func (t *cacheStatsTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return transport.RoundTrip(req)
+	}
+
+	start := time.Now()
+	req, result := withUpstreamResult(req)
+	resp, err = transport.RoundTrip(req)
+	if err == nil {
+		t.stats.record(req, result, time.Since(start))
+	}
+	return
+}
+
+type upstreamStatsTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *upstreamStatsTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err = transport.RoundTrip(req)
+	// Responses synthesized by transports beneath this one (e.g.,
+	// RateLimitTransport) don't count as upstream responses.
+	if result := requestUpstreamResult(req); result != nil && err == nil && !isLocal(resp) {
+		result.contacted = true
+		result.statusCode = resp.StatusCode
+		result.duration = time.Since(start)
+	}
+	return
+}
+
+// Pattern returns the string form of the first of s.Patterns that matches
+// path, or the empty string if none match.
+func (s *CacheStats) Pattern(path string) string {
+	for _, re := range s.Patterns {
+		if re.MatchString(path) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// record counts req, which had the given upstream result.
+func (s *CacheStats) record(req *http.Request, result *upstreamResult, duration time.Duration) {
+	pattern := s.Pattern(req.URL.EscapedPath())
+	outcome := result.outcome()
+
+	s.mu.Lock()
+	if s.counts == nil {
+		s.counts = make(map[string]*CacheCounts)
+	}
+	c := s.counts[pattern]
+	if c == nil {
+		c = new(CacheCounts)
+		s.counts[pattern] = c
+	}
+	switch outcome {
+	case CacheHit, CacheSynthesized:
+		c.Cached++
+		c.RateLimitSaved++
+	case CacheRevalidated:
+		c.Revalidated++
+		c.RateLimitSaved++
+	default:
+		c.Fetched++
+	}
+	s.mu.Unlock()
+
+	if s.OnRequest != nil {
+		s.OnRequest(CacheEvent{
+			Request:            req,
+			Pattern:            pattern,
+			Outcome:            outcome,
+			Duration:           duration,
+			UpstreamStatusCode: result.statusCode,
+			UpstreamDuration:   result.duration,
+			Rule:               result.rule,
+		})
+	}
+}
+
+// Counts returns a snapshot of the counts for each path pattern.
+func (s *CacheStats) Counts() map[string]CacheCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]CacheCounts, len(s.counts))
+	for pattern, c := range s.counts {
+		counts[pattern] = *c
+	}
+	return counts
+}
+
+// ServeHTTP implements net/http.Handler by writing the counts as JSON.
+func (s *CacheStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.MarshalIndent(s.Counts(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
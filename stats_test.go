@@ -0,0 +1,92 @@
+package apiproxy
+
+import (
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCacheStats(t *testing.T) {
+	targetMux := http.NewServeMux()
+	targetMux.HandleFunc("/fresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("fresh"))
+	})
+	targetMux.HandleFunc("/stale", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"foo"`)
+		if r.Header.Get("If-None-Match") == `"foo"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("stale"))
+	})
+	target := httptest.NewServer(targetMux)
+	defer target.Close()
+
+	stats := &CacheStats{Patterns: []*regexp.Regexp{regexp.MustCompile(`^/fresh$`)}}
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = stats.UpstreamTransport(nil)
+	client := &http.Client{Transport: stats.Transport(cachingTransport)}
+
+	for _, path := range []string{"/fresh", "/fresh", "/fresh", "/stale", "/stale"} {
+		resp, err := client.Get(target.URL + path)
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		readAll(t, resp.Body)
+	}
+
+	counts := stats.Counts()
+	if want, got := (CacheCounts{Cached: 2, Fetched: 1, RateLimitSaved: 2}), counts[`^/fresh$`]; want != got {
+		t.Errorf("/fresh: want counts %+v, got %+v", want, got)
+	}
+	if want, got := (CacheCounts{Revalidated: 1, Fetched: 1, RateLimitSaved: 1}), counts[""]; want != got {
+		t.Errorf("/stale: want counts %+v, got %+v", want, got)
+	}
+}
+
+func TestCacheStats_OnRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"foo"`)
+		w.Write([]byte("foo"))
+	}))
+	defer target.Close()
+
+	var outcomes []CacheOutcome
+	var upstreamStatusCodes []int
+	stats := &CacheStats{OnRequest: func(e CacheEvent) {
+		outcomes = append(outcomes, e.Outcome)
+		upstreamStatusCodes = append(upstreamStatusCodes, e.UpstreamStatusCode)
+	}}
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = &RevalidationTransport{
+		Check:     NeverRevalidate,
+		Transport: stats.UpstreamTransport(nil),
+	}
+	client := &http.Client{Transport: stats.Transport(cachingTransport)}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		readAll(t, resp.Body)
+	}
+
+	if want := []CacheOutcome{CacheMiss, CacheSynthesized}; !reflect.DeepEqual(want, outcomes) {
+		t.Errorf("want outcomes %v, got %v", want, outcomes)
+	}
+	if want := []int{http.StatusOK, 0}; !reflect.DeepEqual(want, upstreamStatusCodes) {
+		t.Errorf("want upstream status codes %v, got %v", want, upstreamStatusCodes)
+	}
+	if want, got := (CacheCounts{Cached: 1, Fetched: 1, RateLimitSaved: 1}), stats.Counts()[""]; want != got {
+		t.Errorf("want counts %+v, got %+v", want, got)
+	}
+}
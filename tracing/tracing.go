@@ -0,0 +1,154 @@
+// Package tracing adds OpenTelemetry tracing to apiproxy's transports.
+package tracing
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer.
+const instrumentationName = "github.com/sourcegraph/apiproxy"
+
+// Tracer creates spans for requests through apiproxy's transports. Each
+// request gets a span (created by Transport) that records its cache outcome
+// and Validator decision, with a child span for the upstream request (created
+// by UpstreamTransport). The W3C traceparent header is propagated to the
+// upstream server.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New returns a Tracer that creates spans using tp.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// Transport returns a transport that creates a span for each request to the
+// caching transport t (or net/http.DefaultTransport if t is nil). If the
+// request's context has no span, the span continues the trace in the request's
+// traceparent header (if any).
+func (t *Tracer) Transport(rt http.RoundTripper) http.RoundTripper {
+	return &transport{t, rt}
+}
+
+// UpstreamTransport returns a transport that creates a child span for each
+// upstream request and propagates its trace context in the traceparent header,
+// for use as the underlying transport of the caching transport. If rt is nil,
+// net/http.DefaultTransport is used.
+func (t *Tracer) UpstreamTransport(rt http.RoundTripper) http.RoundTripper {
+	return &upstreamTransport{t, rt}
+}
+
+// InstrumentCacheStats sets s.OnRequest (calling any existing hook as well) to
+// record the route pattern and cache outcome on each request's span.
+func (t *Tracer) InstrumentCacheStats(s *apiproxy.CacheStats) {
+	prev := s.OnRequest
+	s.OnRequest = func(e apiproxy.CacheEvent) {
+		if prev != nil {
+			prev(e)
+		}
+		trace.SpanFromContext(e.Request.Context()).SetAttributes(
+			attribute.String("apiproxy.route", e.Pattern),
+			attribute.String("apiproxy.cache.outcome", string(e.Outcome)),
+		)
+	}
+}
+
+// InstrumentRevalidationTransport sets rt.OnCheck (calling any existing hook as
+// well) to record Validator decisions on each request's span.
+func (t *Tracer) InstrumentRevalidationTransport(rt *apiproxy.RevalidationTransport) {
+	prev := rt.OnCheck
+	rt.OnCheck = func(req *http.Request, age time.Duration, valid bool) {
+		if prev != nil {
+			prev(req, age, valid)
+		}
+		attrs := []attribute.KeyValue{
+			attribute.Float64("apiproxy.cache.age_seconds", age.Seconds()),
+			attribute.Bool("apiproxy.validator.valid", valid),
+		}
+		span := trace.SpanFromContext(req.Context())
+		span.SetAttributes(attrs...)
+		span.AddEvent("revalidation check", trace.WithAttributes(attrs...))
+	}
+}
+
+type transport struct {
+	tracer    *Tracer
+	transport http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	rt := t.transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = t.tracer.propagator.Extract(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	ctx, span := t.tracer.tracer.Start(ctx, "apiproxy "+req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	resp, err = rt.RoundTrip(req.WithContext(ctx))
+	endSpan(span, resp, err)
+	return
+}
+
+type upstreamTransport struct {
+	tracer    *Tracer
+	transport http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	rt := t.transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	ctx, span := t.tracer.tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	t.tracer.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err = rt.RoundTrip(req)
+	endSpan(span, resp, err)
+	return
+}
+
+// endSpan records the result of a round trip on span.
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+}
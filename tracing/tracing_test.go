@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"github.com/sourcegraph/apiproxy"
+	"github.com/sourcegraph/httpcache"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracer(t *testing.T) {
+	var traceparents []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"foo"`)
+		w.Write([]byte("foo"))
+	}))
+	defer target.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	stats := &apiproxy.CacheStats{}
+	tracer.InstrumentCacheStats(stats)
+	revalidationTransport := &apiproxy.RevalidationTransport{
+		Check:     apiproxy.NeverRevalidate,
+		Transport: stats.UpstreamTransport(tracer.UpstreamTransport(nil)),
+	}
+	tracer.InstrumentRevalidationTransport(revalidationTransport)
+	cachingTransport := httpcache.NewMemoryCacheTransport()
+	cachingTransport.Transport = revalidationTransport
+	client := &http.Client{Transport: tracer.Transport(stats.Transport(cachingTransport))}
+
+	// The first request misses the cache and the second gets a synthesized
+	// 304 response.
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal("Get", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("want 3 spans, got %d", len(spans))
+	}
+	upstream, miss, synthesized := spans[0], spans[1], spans[2]
+
+	if upstream.Parent().SpanID() != miss.SpanContext().SpanID() {
+		t.Error("want upstream span to be a child of the first request's span")
+	}
+	if len(traceparents) != 1 || !strings.Contains(traceparents[0], upstream.SpanContext().TraceID().String()+"-"+upstream.SpanContext().SpanID().String()) {
+		t.Errorf("want traceparent of upstream span to be propagated, got %q", traceparents)
+	}
+
+	tests := []struct {
+		span sdktrace.ReadOnlySpan
+		want attribute.KeyValue
+	}{
+		{miss, attribute.String("apiproxy.cache.outcome", "miss")},
+		{synthesized, attribute.String("apiproxy.cache.outcome", "synthesized-304")},
+		{synthesized, attribute.Bool("apiproxy.validator.valid", true)},
+		{upstream, attribute.Int("http.response.status_code", http.StatusOK)},
+	}
+	for _, test := range tests {
+		if !hasAttribute(test.span, test.want) {
+			t.Errorf("span %q: want attribute %s=%s, got %v", test.span.Name(), test.want.Key, test.want.Value.Emit(), test.span.Attributes())
+		}
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, want attribute.KeyValue) bool {
+	for _, kv := range span.Attributes() {
+		if kv == want {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/sourcegraph/httpcache"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -20,33 +21,70 @@ import (
 //
 // If the request does not contain cache validators, then it is passed to the
 // underlying transport.
+//
+// The age of the cache entry is computed from the cached response in Cache (see
+// RFC 9111 section 4.2.3), so it works with any caching transport that stores
+// responses in an httpcache.Cache (including github.com/gregjones/httpcache).
+// If Cache is nil, the age is taken from the X-Cache-Age request header set by
+// the github.com/sourcegraph/httpcache fork, and requests without it are
+// passed to the underlying transport.
 type RevalidationTransport struct {
 	// Check.Valid is called on each request in RoundTrip. If it returns true,
 	// RoundTrip synthesizes and returns an HTTP 304 Not Modified response.
 	// Otherwise, the request is passed through to the underlying transport.
 	Check Validator
 
+	// NegativeCheck, if non-nil, is used instead of Check for cached error
+	// responses (with status codes of 400 or above, e.g., cached by a
+	// CachePolicyTransport's NegativePolicies), so that they can expire on a
+	// different schedule. It requires Cache.
+	NegativeCheck Validator
+
 	// Transport is the underlying transport. If nil, net/http.DefaultTransport is used.
 	Transport http.RoundTripper
+
+	// Cache, if non-nil, is the cache of the caching transport that uses this
+	// transport. The ages of cache entries are computed from the cached
+	// responses, and synthesized 304 Not Modified responses carry the cached
+	// entry's Date, ETag, Last-Modified, Cache-Control, Expires and Vary
+	// headers (as an upstream server's 304 response would). If nil, they only
+	// carry the validators from the request.
+	//
+	// If Cache is set, responses from the underlying transport get
+	// X-Apiproxy-Request-Time and X-Apiproxy-Response-Time headers (stored
+	// with them in the cache) for the age computation.
+	// NewCachingSingleHostReverseProxy removes them from its responses.
+	Cache httpcache.Cache
+
+	// OnCheck, if non-nil, is called after each call to Check.Valid (or
+	// NegativeCheck.Valid) with the
+	// request, the age of the cache entry, and the result (true if a 304 Not
+	// Modified response was synthesized).
+	OnCheck func(req *http.Request, age time.Duration, valid bool)
 }
 
 // RoundTrip takes a Request and returns a Response.
 func (t *RevalidationTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if t.Check != nil && hasCacheValidator(req.Header) {
-		agestr := req.Header.Get(httpcache.XCacheAge)
-		if agestr != "" {
-			var age time.Duration
-			age, err = time.ParseDuration(agestr + "s")
-			if err == nil && t.Check.Valid(req.URL, age) {
-				resp = &http.Response{
-					Request:          req,
-					TransferEncoding: req.TransferEncoding,
-					StatusCode:       http.StatusNotModified,
-					Body:             ioutil.NopCloser(bytes.NewReader([]byte(""))),
+	if (t.Check != nil || t.NegativeCheck != nil) && hasCacheValidator(req.Header) {
+		var cached http.Header
+		check, matches := t.Check, true
+		if t.Cache != nil {
+			if cachedResp := cachedResponse(t.Cache, req); cachedResp != nil {
+				cached = cachedResp.Header
+				// Don't answer for a different variant of the response
+				// (e.g., if the client sent its own validators).
+				matches = varyMatches(cached, req)
+				if t.NegativeCheck != nil && cachedResp.StatusCode >= 400 {
+					check = t.NegativeCheck
 				}
-				return
 			}
 		}
+		if age, ok := cacheEntryAge(req, cached); check != nil && matches && ok && t.check(check, req, age) {
+			if result := requestUpstreamResult(req); result != nil {
+				result.synthesized = true
+			}
+			return notModified(req, cached), nil
+		}
 	}
 
 	transport := t.Transport
@@ -54,7 +92,80 @@ func (t *RevalidationTransport) RoundTrip(req *http.Request) (resp *http.Respons
 		transport = http.DefaultTransport
 	}
 
-	return transport.RoundTrip(req)
+	requestTime := time.Now()
+	resp, err = transport.RoundTrip(req)
+	if err == nil && t.Cache != nil && resp.Header != nil {
+		setResponseTimes(resp.Header, requestTime, time.Now())
+	}
+	if result := requestUpstreamResult(req); result != nil && err == nil {
+		result.contacted = true
+		result.statusCode = resp.StatusCode
+	}
+	return
+}
+
+// check calls check.Valid (where check is t.Check or t.NegativeCheck) and
+// t.OnCheck.
+func (t *RevalidationTransport) check(check Validator, req *http.Request, age time.Duration) bool {
+	if rule, ok := check.(ValidatorRule); ok {
+		if result := requestUpstreamResult(req); result != nil {
+			result.rule = rule.Rule(req.URL)
+		}
+	}
+	valid := check.Valid(req.URL, age)
+	if t.OnCheck != nil {
+		t.OnCheck(req, age, valid)
+	}
+	return valid
+}
+
+// cachedResponse returns the response to req stored in cache (with its body
+// closed), or nil if there is none.
+func cachedResponse(cache httpcache.Cache, req *http.Request) *http.Response {
+	resp, err := httpcache.CachedResponse(cache, req)
+	if err != nil || resp == nil {
+		return nil
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// notModifiedHeaders are the headers of a cached response that are copied to
+// synthesized 304 Not Modified responses (see RFC 9110 section 15.4.5).
+var notModifiedHeaders = []string{"Date", "ETag", "Last-Modified", "Cache-Control", "Expires", "Vary"}
+
+// notModified returns a synthesized 304 Not Modified response to req, which
+// has the notModifiedHeaders of the cached response's headers. If cached is
+// nil, the response's ETag and Last-Modified headers are taken from the
+// request's validators instead.
+func notModified(req *http.Request, cached http.Header) *http.Response {
+	header := make(http.Header)
+	if cached != nil {
+		for _, name := range notModifiedHeaders {
+			name = http.CanonicalHeaderKey(name)
+			if v, present := cached[name]; present {
+				header[name] = v
+			}
+		}
+	} else {
+		if etag := req.Header.Get("If-None-Match"); etag != "" && !strings.Contains(etag, ",") && etag != "*" {
+			header.Set("ETag", etag)
+		}
+		if lastModified := req.Header.Get("If-Modified-Since"); lastModified != "" {
+			header.Set("Last-Modified", lastModified)
+		}
+	}
+	return &http.Response{
+		Status:           "304 Not Modified",
+		StatusCode:       http.StatusNotModified,
+		Proto:            "HTTP/1.1",
+		ProtoMajor:       1,
+		ProtoMinor:       1,
+		Header:           header,
+		Request:          localRequest(req),
+		TransferEncoding: req.TransferEncoding,
+		Body:             ioutil.NopCloser(bytes.NewReader(nil)),
+	}
 }
 
 // hasCacheValidator returns true if the headers contain cache validators. See
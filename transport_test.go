@@ -4,7 +4,10 @@ import (
 	"errors"
 	"github.com/sourcegraph/httpcache"
 	"net/http"
+	"net/url"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestRevalidationTransport_NoValidator(t *testing.T) {
@@ -53,6 +56,147 @@ func TestRevalidationTransport_NeverRevalidate(t *testing.T) {
 	}
 }
 
+func TestRevalidationTransport_NotModifiedHeaders(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	cachedReq := newHTTPGETRequest(t, "http://example.com/foo")
+	cachedHeaders := "HTTP/1.1 200 OK\r\n" +
+		"Date: Mon, 19 Oct 2026 10:00:00 GMT\r\n" +
+		"Etag: \"foo\"\r\n" +
+		"Cache-Control: max-age=60\r\n" +
+		"Vary: Accept\r\n" +
+		"Set-Cookie: a=b\r\n" +
+		"Content-Length: 3\r\n\r\nfoo"
+	cache.Set(cachedReq.URL.String(), []byte(cachedHeaders))
+
+	tests := []struct {
+		cache       httpcache.Cache
+		ifNoneMatch string
+		wantHeader  http.Header
+	}{
+		{
+			cache:       cache,
+			ifNoneMatch: `"foo"`,
+			wantHeader: http.Header{
+				"Date":          []string{"Mon, 19 Oct 2026 10:00:00 GMT"},
+				"Etag":          []string{`"foo"`},
+				"Cache-Control": []string{"max-age=60"},
+				"Vary":          []string{"Accept"},
+			},
+		},
+		// Without a cache, the request's validators are used.
+		{ifNoneMatch: `"foo"`, wantHeader: http.Header{"Etag": []string{`"foo"`}}},
+		{ifNoneMatch: `"foo", "bar"`, wantHeader: http.Header{}},
+	}
+	for _, test := range tests {
+		transport := &RevalidationTransport{Check: NeverRevalidate, Cache: test.cache, Transport: newMockTransport()}
+		req := newHTTPGETRequest(t, "http://example.com/foo")
+		req.Header.Add("if-none-match", test.ifNoneMatch)
+		req.Header.Add(httpcache.XCacheAge, `10`)
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal("RoundTrip", err)
+		}
+		if resp.StatusCode != http.StatusNotModified || resp.Status != "304 Not Modified" || resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+			t.Errorf("%q: want a 304 Not Modified HTTP/1.1 response, got %q %s", test.ifNoneMatch, resp.Status, resp.Proto)
+		}
+		if !reflect.DeepEqual(resp.Header, test.wantHeader) {
+			t.Errorf("%q: want header %v, got %v", test.ifNoneMatch, test.wantHeader, resp.Header)
+		}
+	}
+}
+
+func TestRevalidationTransport_CacheAge(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	date := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	cache.Set("http://example.com/foo", []byte("HTTP/1.1 200 OK\r\nDate: "+date+"\r\nEtag: \"foo\"\r\nContent-Length: 0\r\n\r\n"))
+
+	var checkedAge time.Duration
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	transport := &RevalidationTransport{
+		Check: ValidatorFunc(func(url *url.URL, age time.Duration) bool {
+			checkedAge = age
+			return age < 2*time.Hour
+		}),
+		Cache:     cache,
+		Transport: mockTransport,
+	}
+
+	// The age is computed from the cached response (without X-Cache-Age).
+	req := newHTTPGETRequest(t, "http://example.com/foo")
+	req.Header.Add("if-none-match", `"foo"`)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("want a synthesized 304 response, got %d", resp.StatusCode)
+	}
+	if checkedAge < time.Hour || checkedAge > time.Hour+time.Minute {
+		t.Errorf("want age of about 1h, got %s", checkedAge)
+	}
+
+	// Responses from the underlying transport get response time headers.
+	req = newHTTPGETRequest(t, "http://example.com/bar")
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if resp.Header.Get(requestTimeHeader) == "" || resp.Header.Get(responseTimeHeader) == "" {
+		t.Errorf("want response time headers, got %v", resp.Header)
+	}
+}
+
+func TestRevalidationTransport_VaryMismatch(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	date := time.Now().UTC().Format(http.TimeFormat)
+	cache.Set("http://example.com/foo", []byte("HTTP/1.1 200 OK\r\nDate: "+date+"\r\nEtag: \"foo\"\r\nVary: Accept\r\nX-Varied-Accept: application/json\r\nContent-Length: 0\r\n\r\n"))
+
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	transport := &RevalidationTransport{Check: NeverRevalidate, Cache: cache, Transport: mockTransport}
+
+	// The cached response is for a different Accept header, so the client's
+	// validators must be checked upstream.
+	req := newHTTPGETRequest(t, "http://example.com/foo")
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("If-None-Match", `"foo"`)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(mockTransport.requests) != 1 {
+		t.Errorf("want request passed to underlying transport, got %d response and %d requests", resp.StatusCode, len(mockTransport.requests))
+	}
+}
+
+func TestRevalidationTransport_OnCheck(t *testing.T) {
+	mockTransport := newMockTransport()
+	mockTransport.defaultResponse = &http.Response{Header: http.Header{}}
+
+	var checkedAge time.Duration
+	var checkedValid bool
+	transport := &RevalidationTransport{
+		Check: NeverRevalidate,
+		OnCheck: func(req *http.Request, age time.Duration, valid bool) {
+			checkedAge, checkedValid = age, valid
+		},
+		Transport: mockTransport,
+	}
+
+	req := newHTTPGETRequest(t, "")
+	req.Header.Add("if-none-match", `"foo"`)
+	req.Header.Add(httpcache.XCacheAge, `10`)
+
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Error("RoundTrip", err)
+	}
+	if want := 10 * time.Second; checkedAge != want || !checkedValid {
+		t.Errorf("want OnCheck called with age %s and valid true, got %s and %v", want, checkedAge, checkedValid)
+	}
+}
+
 func newMockTransport() *mockTransport {
 	return &mockTransport{
 		responses: make(map[*http.Request]*http.Response),
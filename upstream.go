@@ -0,0 +1,108 @@
+package apiproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// UpstreamOptions configure the connections to an upstream server. Use
+// Transport to create a transport with the options, e.g., as the underlying
+// transport of NewCachingSingleHostReverseProxy's RevalidationTransport:
+//
+//	t, err := (&apiproxy.UpstreamOptions{CAFile: "internal-ca.pem"}).Transport()
+//	...
+//	proxy := apiproxy.NewCachingSingleHostReverseProxy(target, nil)
+//	proxy.Transport.(*httpcache.Transport).Transport = &apiproxy.RevalidationTransport{Transport: t}
+//
+// Zero values leave the settings of net/http.DefaultTransport unchanged.
+type UpstreamOptions struct {
+	// CAFile is a PEM file of CA certificates that are trusted (in addition
+	// to the system's) to sign upstream server certificates.
+	CAFile string
+
+	// CertFile and KeyFile are PEM files containing a client certificate and
+	// its key, which are presented to upstream servers that request them
+	// (for mutual TLS).
+	CertFile string
+	KeyFile  string
+
+	// InsecureSkipVerify disables verification of upstream server
+	// certificates. It should only be used in development.
+	InsecureSkipVerify bool
+
+	// DisableHTTP2 prevents the use of HTTP/2 with upstream servers.
+	DisableHTTP2 bool
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections to keep
+	// open to each upstream host.
+	MaxIdleConnsPerHost int
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout limit the
+	// time taken to connect to an upstream server, to complete the TLS
+	// handshake, and to receive the response headers after sending a request.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Proxy is the URL of a proxy through which upstream requests are sent.
+	// If nil, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are used.
+	Proxy *url.URL
+}
+
+// Transport returns a transport configured with the options.
+func (o *UpstreamOptions) Transport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.InsecureSkipVerify {
+		config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+		if o.CAFile != "" {
+			pem, err := ioutil.ReadFile(o.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+				config.RootCAs = x509.NewCertPool()
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+			}
+		}
+		if o.CertFile != "" || o.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		t.TLSClientConfig = config
+	}
+
+	if o.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	if o.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.DialTimeout != 0 {
+		t.DialContext = (&net.Dialer{Timeout: o.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if o.TLSHandshakeTimeout != 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout != 0 {
+		t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.Proxy != nil {
+		t.Proxy = http.ProxyURL(o.Proxy)
+	}
+	return t, nil
+}
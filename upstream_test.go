@@ -0,0 +1,83 @@
+package apiproxy
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamOptions_Transport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apiproxy-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opt       UpstreamOptions
+		wantErr   bool
+		wantProto string
+	}{
+		{UpstreamOptions{}, true, ""},
+		{UpstreamOptions{CAFile: caFile}, false, "HTTP/2.0"},
+		{UpstreamOptions{InsecureSkipVerify: true}, false, "HTTP/2.0"},
+		{UpstreamOptions{CAFile: caFile, DisableHTTP2: true}, false, "HTTP/1.1"},
+	}
+	for i, test := range tests {
+		transport, err := test.opt.Transport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if test.wantErr {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%d: want certificate verification error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: Get: %s", i, err)
+			continue
+		}
+		if body := string(readAll(t, resp.Body)); test.wantProto != body {
+			t.Errorf("%d: want protocol %s, got %s", i, test.wantProto, body)
+		}
+	}
+}
+
+func TestUpstreamOptions_Transport_Proxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedURL = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	transport, err := (&UpstreamOptions{Proxy: mustParseURL(t, proxy.URL)}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://upstream.example.com/foo")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	readAll(t, resp.Body)
+	if want := "http://upstream.example.com/foo"; proxiedURL != want {
+		t.Errorf("want proxied URL %q, got %q", want, proxiedURL)
+	}
+}
@@ -3,6 +3,7 @@ package apiproxy
 import (
 	"net/url"
 	"regexp"
+	"regexp/syntax"
 	"time"
 )
 
@@ -14,6 +15,14 @@ type Validator interface {
 	Valid(url *url.URL, age time.Duration) bool
 }
 
+// ValidatorRule is implemented by Validators that can describe the rule they
+// apply to a URL (e.g., for the Cache-Status response header).
+type ValidatorRule interface {
+	// Rule returns a description of the rule that applies to url, or the
+	// empty string if no rule applies.
+	Rule(url *url.URL) string
+}
+
 // ValidatorFunc is an adapter type to allow the use of ordinary functions as
 // validators. If f is a function with the appropriate signature,
 // ValidatorFunc(f) is a Validator object that calls f.
@@ -32,15 +41,85 @@ var NeverRevalidate = ValidatorFunc(func(_ *url.URL, _ time.Duration) bool {
 })
 
 // PathMatchValidator is a map of path regexps to the maximum age of resources
-// matching one of those regexps.
+// whose escaped paths (see net/url.URL.EscapedPath) match one of those
+// regexps. If more than one regexp matches a path, the most specific one (the
+// one that requires the most literal characters, e.g., ^/a/b$ rather than
+// ^/a/.*$ or ^/a) applies; ties go to the longer regexp, then to the one whose
+// string form sorts first.
 type PathMatchValidator map[*regexp.Regexp]time.Duration
 
 // Valid implements Validator.
 func (v PathMatchValidator) Valid(url *url.URL, age time.Duration) bool {
-	for re, maxAge := range v {
-		if re.MatchString(url.Path) {
-			return age <= maxAge
-		}
+	if re := v.match(url); re != nil {
+		return age <= v[re]
 	}
 	return false
 }
+
+// Rule implements ValidatorRule by returning the path regexp that matches url.
+func (v PathMatchValidator) Rule(url *url.URL) string {
+	if re := v.match(url); re != nil {
+		return re.String()
+	}
+	return ""
+}
+
+// match returns the regexp that applies to url, or nil if none match.
+func (v PathMatchValidator) match(url *url.URL) *regexp.Regexp {
+	path := url.EscapedPath()
+	var match *regexp.Regexp
+	for re := range v {
+		if re.MatchString(path) && (match == nil || moreSpecific(re.String(), match.String())) {
+			match = re
+		}
+	}
+	return match
+}
+
+// moreSpecific returns true if the regexp a takes precedence over b in a
+// PathMatchValidator.
+func moreSpecific(a, b string) bool {
+	if la, lb := literalLength(a), literalLength(b); la != lb {
+		return la > lb
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a < b
+}
+
+// literalLength returns the number of literal characters that every match of
+// the regexp expr contains.
+func literalLength(expr string) int {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	var length func(re *syntax.Regexp) int
+	length = func(re *syntax.Regexp) int {
+		switch re.Op {
+		case syntax.OpLiteral:
+			return len(re.Rune)
+		case syntax.OpCapture, syntax.OpPlus:
+			return length(re.Sub[0])
+		case syntax.OpRepeat:
+			return re.Min * length(re.Sub[0])
+		case syntax.OpConcat:
+			n := 0
+			for _, sub := range re.Sub {
+				n += length(sub)
+			}
+			return n
+		case syntax.OpAlternate:
+			n := -1
+			for _, sub := range re.Sub {
+				if m := length(sub); n == -1 || m < n {
+					n = m
+				}
+			}
+			return n
+		}
+		return 0
+	}
+	return length(re)
+}
@@ -28,3 +28,35 @@ func TestPathMatchValidator(t *testing.T) {
 		}
 	}
 }
+
+func TestPathMatchValidator_Overlapping(t *testing.T) {
+	v := PathMatchValidator{
+		regexp.MustCompile(`^/a`):       time.Hour,
+		regexp.MustCompile(`^/a/b$`):    time.Second,
+		regexp.MustCompile(`^/a/.*$`):   time.Minute,
+		regexp.MustCompile(`^/a/[bc]$`): 2 * time.Minute,
+	}
+	tests := []struct {
+		path     string
+		wantRule string
+		maxAge   time.Duration
+	}{
+		// The most specific pattern applies.
+		{"/a/b", `^/a/b$`, time.Second},
+		{"/a/c", `^/a/[bc]$`, 2 * time.Minute},
+		{"/a/d", `^/a/.*$`, time.Minute},
+		{"/abc", `^/a`, time.Hour},
+	}
+	for _, test := range tests {
+		u := &url.URL{Path: test.path}
+		// The same regexp applies each time, for both Valid and Rule.
+		for i := 0; i < 20; i++ {
+			if rule := v.Rule(u); rule != test.wantRule {
+				t.Fatalf("%s: want rule %q, got %q", test.path, test.wantRule, rule)
+			}
+			if !v.Valid(u, test.maxAge) || v.Valid(u, test.maxAge+time.Second) {
+				t.Fatalf("%s: want max-age %s", test.path, test.maxAge)
+			}
+		}
+	}
+}
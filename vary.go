@@ -0,0 +1,150 @@
+package apiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sourcegraph/httpcache"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// varyCache is an httpcache.Cache that stores each variant of a response with
+// a Vary header under its own key, so that responses for different values of
+// the Vary request headers (e.g., Accept) don't replace each other.
+//
+// The variant's key is the URL with a fragment derived from the request's
+// values of the Vary headers. setVariant sets the fragment on requests before
+// they are passed to the caching transport (fragments aren't sent to upstream
+// servers). The Vary header names of each URL are stored in the underlying
+// cache, under the URL prefixed with "vary ".
+//
+// If identity is set, the fragment also identifies the client that made the
+// request, so that each client's responses are cached separately.
+type varyCache struct {
+	httpcache.Cache
+	identity func(req *http.Request) string
+}
+
+// Set implements httpcache.Cache. It stores the response under the key of its
+// variant (computed from the X-Varied-* headers that httpcache adds, and the
+// client part of key's fragment) and records its Vary header names.
+func (c *varyCache) Set(key string, respBytes []byte) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
+	if err != nil {
+		c.Cache.Set(key, respBytes)
+		return
+	}
+	resp.Body.Close()
+
+	var client string
+	if i := strings.Index(key, "#"); i != -1 {
+		for _, part := range strings.Split(key[i+1:], "+") {
+			if strings.HasPrefix(part, "client-") {
+				client = part
+			}
+		}
+		key = key[:i]
+	}
+	names := varyNames(resp.Header)
+	for _, name := range names {
+		if name == "*" {
+			// The response varies on more than request headers.
+			c.Cache.Delete(withFragment(key, client))
+			return
+		}
+	}
+	if len(names) == 0 {
+		c.Cache.Delete(varyIndexKey(key))
+		c.Cache.Set(withFragment(key, client), respBytes)
+		return
+	}
+	c.Cache.Set(varyIndexKey(key), []byte(strings.Join(names, ",")))
+	c.Cache.Set(withFragment(key, client, variantFragment(names, func(name string) string {
+		return resp.Header.Get("X-Varied-" + name)
+	})), respBytes)
+}
+
+// setVariant sets req's URL fragment to identify the variant of the cached
+// response that req selects.
+func (c *varyCache) setVariant(req *http.Request) {
+	req.URL.Fragment = ""
+	var parts []string
+	if c.identity != nil {
+		if identity := c.identity(req); identity != "" {
+			sum := sha256.Sum256([]byte(identity))
+			parts = append(parts, "client-"+hex.EncodeToString(sum[:16]))
+		}
+	}
+	if index, ok := c.Cache.Get(varyIndexKey(req.URL.String())); ok && len(index) > 0 {
+		parts = append(parts, variantFragment(strings.Split(string(index), ","), req.Header.Get))
+	}
+	req.URL.Fragment = strings.Join(parts, "+")
+}
+
+// withFragment returns key with a fragment made of the non-empty parts.
+func withFragment(key string, parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return key
+	}
+	return key + "#" + strings.Join(nonEmpty, "+")
+}
+
+// varyIndexKey returns the key under which the Vary header names of responses
+// with the given cache key (without a fragment) are stored.
+func varyIndexKey(key string) string {
+	// Keys of responses to HEAD requests are prefixed with the method.
+	if i := strings.Index(key, " "); i != -1 {
+		key = key[i+1:]
+	}
+	return "vary " + key
+}
+
+// variantFragment returns the URL fragment that identifies the variant with the
+// given values of the Vary header names. The values are hashed so that
+// credentials (e.g., with Vary: Authorization) don't appear in cache keys.
+func variantFragment(names []string, value func(name string) string) string {
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%q\n", name, value(name))
+	}
+	return "vary-" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// varyNames returns the sorted, canonicalized header names in h's Vary headers.
+func varyNames(h http.Header) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyMatches returns true if req has the same values of the cached response's
+// Vary headers as the request that the response was cached for (which
+// httpcache stores in X-Varied-* headers).
+func varyMatches(cached http.Header, req *http.Request) bool {
+	for _, name := range varyNames(cached) {
+		if name == "*" || req.Header.Get(name) != cached.Get("X-Varied-"+name) {
+			return false
+		}
+	}
+	return true
+}